@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 
 	"github.com/4aykovksi/medods_test_task/internal/config"
+	"github.com/4aykovksi/medods_test_task/internal/model"
 	"github.com/4aykovksi/medods_test_task/internal/repository/mongorepos"
 	v1 "github.com/4aykovksi/medods_test_task/internal/rest/v1"
 	"github.com/4aykovksi/medods_test_task/internal/services"
 	"github.com/4aykovksi/medods_test_task/pkg/database/mongodb"
 	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
 	"github.com/4aykovksi/medods_test_task/pkg/lib/hasher"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/mail"
 )
 
 func main() {
@@ -34,17 +39,113 @@ func main() {
 	// init repos
 	userRepo := mongorepos.NewUserRepository(db)
 	sessionRepo := mongorepos.NewRefreshSessionsRepository(db)
+	securityEventRepo := mongorepos.NewSecurityEventRepository(db)
+	clientRepo := mongorepos.NewClientRepository(db)
+	authCodeRepo := mongorepos.NewAuthorizationCodeRepository(db)
+	revokedTokenRepo := mongorepos.NewRevokedTokenRepository(db)
+	loginAttemptsRepo := mongorepos.NewLoginAttemptsRepository(db)
+
+	err = userRepo.EnsureIndexes(context.Background())
+	if err != nil {
+		log.Error("can't create user indexes", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+
+	err = sessionRepo.EnsureIndexes(context.Background())
+	if err != nil {
+		log.Error("can't create refresh session indexes", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+
+	err = clientRepo.EnsureIndexes(context.Background())
+	if err != nil {
+		log.Error("can't create client indexes", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+
+	// first-party application signs in and refreshes tokens without client_id
+	if cfg.DefaultClientID != "" {
+		err = clientRepo.EnsureClient(context.Background(), model.Client{
+			ClientID:      cfg.DefaultClientID,
+			Name:          "first-party application",
+			AllowedGrants: []string{model.GrantSignIn},
+		})
+		if err != nil {
+			log.Error("can't register default client", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	err = authCodeRepo.EnsureIndexes(context.Background())
+	if err != nil {
+		log.Error("can't create authorization code indexes", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+
+	err = revokedTokenRepo.EnsureIndexes(context.Background())
+	if err != nil {
+		log.Error("can't create revoked token indexes", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+
+	err = loginAttemptsRepo.EnsureIndexes(context.Background())
+	if err != nil {
+		log.Error("can't create login attempts indexes", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
 
 	// init services
 
-	bcryptHasher := hasher.NewBcryptHasher()
-	tokenManager := auth.NewManager(cfg.Secret)
+	multiHasher, err := hasher.NewMultiHasher(
+		cfg.Hashing.Algorithm,
+		hasher.NewBcryptHasher(cfg.Hashing.BcryptCost),
+		hasher.NewArgon2idHasher(cfg.Hashing.Argon2id.Time, cfg.Hashing.Argon2id.MemoryKiB, cfg.Hashing.Argon2id.Threads),
+		hasher.NewScryptHasher(cfg.Hashing.Scrypt.CostLog2, cfg.Hashing.Scrypt.BlockSize, cfg.Hashing.Scrypt.Parallelism),
+	)
+	if err != nil {
+		log.Error("can't create hasher", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	passwordHasher := hasher.NewPool(multiHasher, cfg.Hashing.Parallelism, cfg.Hashing.QueueDepth)
+	expvar.Publish("hasher_pool", passwordHasher.Metrics())
 
-	sessionService := services.NewRefreshSessionService(sessionRepo, bcryptHasher, cfg.MaxSessionCount)
-	authService := services.NewAuthService(userRepo, sessionService, tokenManager, bcryptHasher, cfg.AccessTokenTTL, cfg.RefreshTokenTTL)
+	keySet, err := loadKeySet(log, cfg.JWT)
+	if err != nil {
+		log.Error("can't load signing keys", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	tokenManager := auth.NewManager(keySet, cfg.JWT.Issuer, cfg.JWT.Audience)
+
+	var mailSender mail.Sender
+	if cfg.Mail.SMTPHost != "" {
+		mailSender = mail.NewSMTPSender(cfg.Mail.SMTPHost, cfg.Mail.SMTPPort, cfg.Mail.SMTPUsername, cfg.Mail.SMTPPassword, cfg.Mail.From)
+	} else {
+		log.Warn("smtp host isn't specified, emails are written to outbox", slog.String("path", cfg.Mail.OutboxPath))
+		mailSender = mail.NewOutbox(cfg.Mail.OutboxPath, cfg.Mail.OutboxLimit)
+	}
+	mailSender = mail.NewQueue(log, mailSender, cfg.Mail.QueueSize, cfg.Mail.SendTimeout)
+
+	sessionService := services.NewRefreshSessionService(sessionRepo, securityEventRepo, userRepo, passwordHasher, cfg.MaxSessionCount, cfg.RefreshGracePeriod)
+	clientService := services.NewClientService(clientRepo, passwordHasher)
+	userService := services.NewUserService(userRepo, sessionService, passwordHasher)
+	tokenDenylist := services.NewTokenDenylistService(revokedTokenRepo)
+	throttleService := services.NewThrottleService(loginAttemptsRepo, cfg.Throttle.Threshold, cfg.Throttle.BaseDelay, cfg.Throttle.MaxDelay, cfg.Throttle.Window)
+	authService := services.NewAuthService(log, userRepo, clientRepo, authCodeRepo, sessionService, tokenDenylist, throttleService, tokenManager, passwordHasher, mailSender, cfg.AccessTokenTTL, cfg.RefreshTokenTTL, cfg.AuthCodeTTL, cfg.DefaultClientID)
 
 	// init router
-	r := v1.NewRouter(log, authService)
+	r := v1.NewRouter(log, authService, sessionService, clientService, userService, tokenManager, tokenDenylist)
+
+	// run metrics server, expvar handler is registered in default mux
+	if cfg.HTTPServer.MetricsAddress != "" {
+		go func() {
+			log.Info("metrics server started", slog.String("address", cfg.HTTPServer.MetricsAddress))
+
+			err := http.ListenAndServe(cfg.HTTPServer.MetricsAddress, nil)
+			if err != nil {
+				log.Error("metrics server stopped", slog.String("err", err.Error()))
+			}
+		}()
+	}
 
 	// run server
 	log.Info("server started", slog.String("address", cfg.HTTPServer.Address))
@@ -59,3 +160,57 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// loadKeySet reads signing keys from config. The first key signs tokens, the others are kept for verification
+func loadKeySet(log *slog.Logger, cfg config.JWT) (*auth.KeySet, error) {
+	const op = "cmd.app.main.loadKeySet"
+
+	if len(cfg.SigningKeys) == 0 {
+		log.Warn("signing keys aren't specified, generating ephemeral key", slog.String("alg", cfg.SigningAlgorithm))
+
+		key, err := auth.GenerateKey(cfg.SigningAlgorithm)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		return auth.NewKeySet(key)
+	}
+
+	keys := make([]*auth.Key, 0, len(cfg.SigningKeys))
+	for _, keyCfg := range cfg.SigningKeys {
+		data, err := os.ReadFile(keyCfg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		key, err := auth.ParseKeyPEM(keyCfg.ID, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if !cfg.SigningKeys[0].RetiredUntil.IsZero() {
+		return nil, fmt.Errorf("%s: signing key %q can't be retired", op, keys[0].ID)
+	}
+
+	keySet, err := auth.NewKeySet(keys[0], keys[1:]...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// keys without deadline stay active, so they're published before they start signing
+	for i, keyCfg := range cfg.SigningKeys[1:] {
+		if keyCfg.RetiredUntil.IsZero() {
+			continue
+		}
+
+		err = keySet.Retire(keys[i+1].ID, keyCfg.RetiredUntil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return keySet, nil
+}
@@ -2,20 +2,105 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"runtime"
 	"time"
 )
 
 type Config struct {
-	Secret          string
 	MaxSessionCount int
 	HTTPServer      HTTPServer
 	Mongodb         Mongodb
+	JWT             JWT
+	Mail            Mail
 	AccessTokenTTL  time.Duration
 	RefreshTokenTTL time.Duration
+	// AuthCodeTTL is lifetime of OAuth authorization code
+	AuthCodeTTL time.Duration
+	// RefreshGracePeriod is time rotated refresh token returns the same new tokens pair to concurrent requests.
+	// Zero disables it
+	RefreshGracePeriod time.Duration
+	// DefaultClientID is id of first-party client used by sign-in and refresh requests without client_id.
+	// It's registered on start if it doesn't exist. Set by DEFAULT_CLIENT_ID, empty value makes client_id required
+	DefaultClientID string
+	Throttle        Throttle
+	Hashing         Hashing
 }
 
+// Hashing configures hashing of passwords, client secrets and refresh tokens.
+// New hashes are created with Algorithm: bcrypt, argon2id or scrypt. Hashes of any of them are verified,
+// and password hash of other algorithm or with other parameters is replaced on successful sign-in
+// At most Parallelism hashes are computed at once and up to QueueDepth wait for their turn, others are rejected
+type Hashing struct {
+	Algorithm   string
+	BcryptCost  int
+	Argon2id    Argon2id
+	Scrypt      Scrypt
+	Parallelism int
+	QueueDepth  int
+}
+
+type Argon2id struct {
+	Time      uint32
+	MemoryKiB uint32
+	Threads   uint8
+}
+
+// Scrypt parameters, CPU/memory cost N is 2^CostLog2
+type Scrypt struct {
+	CostLog2    uint8
+	BlockSize   int
+	Parallelism int
+}
+
+// Throttle configures lockout after failed sign-in and refresh attempts.
+// After Threshold failures user, IP or token is locked for BaseDelay, every next failure doubles the lock up to MaxDelay.
+// Failures are forgotten after Window without new ones
+type Throttle struct {
+	Threshold int64
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+}
+
+// HTTPServer configures API listener. If MetricsAddress isn't empty, expvar metrics are served on it at /debug/vars
 type HTTPServer struct {
-	Address string
+	Address        string
+	MetricsAddress string
+}
+
+// JWT describes keys used to sign access tokens.
+// The first of SigningKeys signs new tokens, the rest are only used for verification and are published in JWKS,
+// so the next key can be published before rotation, which is done by moving it in front of the list.
+// Key with RetiredUntil is retired: it's verified and published only until then, so it should be kept
+// for access token lifetime after rotation.
+// If SigningKeys is empty, an ephemeral key of SigningAlgorithm is generated on start
+type JWT struct {
+	Issuer           string
+	Audience         string
+	SigningAlgorithm string
+	SigningKeys      []SigningKey
+}
+
+type SigningKey struct {
+	ID           string
+	Path         string
+	RetiredUntil time.Time
+}
+
+// Mail configures delivery of notification emails.
+// If SMTP host is empty, messages are written to outbox file instead of being sent, OutboxLimit last of them are kept
+// in memory. Messages are sent in background: up to QueueSize wait for delivery, each delivery takes up to SendTimeout
+type Mail struct {
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	From         string
+	OutboxPath   string
+	OutboxLimit  int
+	QueueSize    int
+	SendTimeout  time.Duration
 }
 
 type Mongodb struct {
@@ -28,16 +113,60 @@ type Mongodb struct {
 func MustLoad() *Config {
 	// из-за ограниченного стека используемых технологий не использую godotenv и cleanenv для заполнения конфига
 	cfg := &Config{
-		Secret:          "get_secret_from_env",
 		MaxSessionCount: 3,
-		HTTPServer:      HTTPServer{Address: "localhost:8080"},
+		HTTPServer: HTTPServer{
+			Address:        "localhost:8080",
+			MetricsAddress: "localhost:9090",
+		},
 		Mongodb: Mongodb{
 			Host:     "localhost",
 			Port:     27017,
 			Database: "medods_test_task",
 		},
-		AccessTokenTTL:  15 * time.Minute,
-		RefreshTokenTTL: 60 * 24 * 60 * time.Minute,
+		JWT: JWT{
+			Issuer:           "http://localhost:8080",
+			Audience:         "medods_test_task",
+			SigningAlgorithm: "RS256",
+		},
+		Mail: Mail{
+			SMTPPort:    587,
+			From:        "no-reply@medods.local",
+			OutboxPath:  "mail_outbox.jsonl",
+			OutboxLimit: 100,
+			QueueSize:   100,
+			SendTimeout: 10 * time.Second,
+		},
+		AccessTokenTTL:     15 * time.Minute,
+		RefreshTokenTTL:    60 * 24 * 60 * time.Minute,
+		AuthCodeTTL:        time.Minute,
+		RefreshGracePeriod: 10 * time.Second,
+		DefaultClientID:    "first_party",
+		Throttle: Throttle{
+			Threshold: 5,
+			BaseDelay: time.Second,
+			MaxDelay:  15 * time.Minute,
+			Window:    time.Hour,
+		},
+		Hashing: Hashing{
+			Algorithm:  "bcrypt",
+			BcryptCost: 12,
+			Argon2id: Argon2id{
+				Time:      3,
+				MemoryKiB: 64 * 1024,
+				Threads:   2,
+			},
+			Scrypt: Scrypt{
+				CostLog2:    15,
+				BlockSize:   8,
+				Parallelism: 1,
+			},
+			Parallelism: runtime.NumCPU(),
+			QueueDepth:  64,
+		},
+	}
+
+	if clientID, ok := os.LookupEnv("DEFAULT_CLIENT_ID"); ok {
+		cfg.DefaultClientID = clientID
 	}
 
 	cfg.Mongodb.URI = fmt.Sprintf("mongodb://%s:%d", cfg.Mongodb.Host, cfg.Mongodb.Port)
@@ -0,0 +1,20 @@
+package model
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// AuthorizationCode is single-use code of OAuth 2.0 authorization code flow. Only SHA-256 of code is stored
+type AuthorizationCode struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	CodeHash    string             `bson:"code_hash"`
+	ClientID    string             `bson:"client_id"`
+	GUID        string             `bson:"guid"`
+	RedirectURI string             `bson:"redirect_uri"`
+	// RedirectURIProvided is set if redirect_uri was sent to authorization endpoint, RFC 6749 section 4.1.3
+	RedirectURIProvided bool               `bson:"redirect_uri_provided"`
+	Scopes              []string           `bson:"scopes,omitempty"`
+	CodeChallenge       string             `bson:"code_challenge"`
+	CodeChallengeMethod string             `bson:"code_challenge_method"`
+	Nonce               string             `bson:"nonce,omitempty"`
+	CreatedAt           primitive.DateTime `bson:"created_at"`
+	ExpiresAt           primitive.DateTime `bson:"expires_at"`
+}
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Grant types client can be allowed to use
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+	// GrantSignIn allows first-party sign-in through /api/v1/auth endpoints
+	GrantSignIn = "sign_in"
+)
+
+// ScopeTokensRevoke allows confidential client to revoke tokens issued to other clients and first-party applications
+const ScopeTokensRevoke = "tokens:revoke"
+
+// Client is registered application allowed to get tokens. Public clients, e.g. SPAs and mobile apps, don't have secret
+type Client struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	ClientID      string             `bson:"client_id"`
+	Name          string             `bson:"name,omitempty"`
+	SecretHash    string             `bson:"secret_hash,omitempty"`
+	AllowedGrants []string           `bson:"allowed_grants,omitempty"`
+	Scopes        []string           `bson:"scopes,omitempty"`
+	RedirectURIs  []string           `bson:"redirect_uris,omitempty"`
+	// AccessTokenTTL and RefreshTokenTTL are token lifetimes in seconds. Zero means global config value is used
+	AccessTokenTTL  int64 `bson:"access_token_ttl,omitempty"`
+	RefreshTokenTTL int64 `bson:"refresh_token_ttl,omitempty"`
+}
+
+func (c *Client) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
+}
+
+func (c *Client) AllowsGrant(grant string) bool {
+	return slices.Contains(c.AllowedGrants, grant)
+}
+
+// TokenTTLs returns client token lifetimes, given defaults are used for ones client doesn't override
+func (c *Client) TokenTTLs(defaultAccessTTL time.Duration, defaultRefreshTTL time.Duration) (time.Duration, time.Duration) {
+	accessTTL, refreshTTL := defaultAccessTTL, defaultRefreshTTL
+	if c.AccessTokenTTL > 0 {
+		accessTTL = time.Duration(c.AccessTokenTTL) * time.Second
+	}
+	if c.RefreshTokenTTL > 0 {
+		refreshTTL = time.Duration(c.RefreshTokenTTL) * time.Second
+	}
+
+	return accessTTL, refreshTTL
+}
+
+func (c *Client) IsPublic() bool {
+	return c.SecretHash == ""
+}
+
+// RedirectURI returns registered redirect URI which exactly matches requested one.
+// If nothing is requested, the only registered URI is used
+func (c *Client) RedirectURI(requested string) (string, bool) {
+	if requested == "" {
+		if len(c.RedirectURIs) != 1 {
+			return "", false
+		}
+		return c.RedirectURIs[0], true
+	}
+
+	if !slices.Contains(c.RedirectURIs, requested) {
+		return "", false
+	}
+
+	return requested, true
+}
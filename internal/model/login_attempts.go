@@ -0,0 +1,18 @@
+package model
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// LoginAttempts counts failed sign-in and refresh attempts made for Key: user, IP or refresh token selector.
+// Entry is removed by TTL index at ExpiresAt, so counter starts over after a period without failures
+type LoginAttempts struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Key      string             `bson:"key"`
+	Failures int64              `bson:"failures"`
+	// LockedUntil is set when Failures reaches threshold, attempts for Key are rejected until then
+	LockedUntil primitive.DateTime `bson:"locked_until,omitempty"`
+	ExpiresAt   primitive.DateTime `bson:"expires_at"`
+}
+
+func (a *LoginAttempts) IsLocked(now primitive.DateTime) bool {
+	return a.LockedUntil > now
+}
@@ -1,10 +1,54 @@
 package model
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type RefreshSession struct {
-	ID           primitive.ObjectID `bson:"_id,omitempty"`
-	GUID         string             `bson:"guid"`
-	RefreshToken string             `bson:"refresh_token"`
-	ExpiresIn    primitive.DateTime `bson:"expires_in"`
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	GUID     string             `bson:"guid"`
+	FamilyID string             `bson:"family_id,omitempty"`
+	ClientID string             `bson:"client_id,omitempty"`
+	// Grant is grant type session family was started with. It's empty for sessions created before clients were registered
+	Grant string `bson:"grant,omitempty"`
+	// Scopes are scopes granted to OAuth client with authorization code. Other sessions get user permissions instead
+	Scopes []string `bson:"scopes,omitempty"`
+	// TokenVersion is user's token version the session was created with
+	TokenVersion  int64              `bson:"token_version,omitempty"`
+	Selector      string             `bson:"selector,omitempty"`
+	RefreshToken  string             `bson:"refresh_token"`
+	AccessTokenID string             `bson:"access_token_id"`
+	IP            string             `bson:"ip,omitempty"`
+	UserAgent     string             `bson:"user_agent,omitempty"`
+	DeviceLabel   string             `bson:"device_label,omitempty"`
+	CreatedAt     primitive.DateTime `bson:"created_at"`
+	LastUsedAt    primitive.DateTime `bson:"last_used_at"`
+	ExpiresIn     primitive.DateTime `bson:"expires_in"`
+	// RotatedAt is set when token was exchanged for a new one. Rotated session is kept until expiration to detect reuse
+	RotatedAt primitive.DateTime `bson:"rotated_at,omitempty"`
+	// Successor is tokens pair the token was exchanged for, sealed with the token. It's returned to requests
+	// which present the same token within refresh grace period. After SuccessorExpiresAt it's ignored
+	// and unset on next rotation of the family
+	Successor          []byte             `bson:"successor,omitempty"`
+	SuccessorExpiresAt primitive.DateTime `bson:"successor_expires_at,omitempty"`
+}
+
+func (s *RefreshSession) IsRotated() bool {
+	return s.RotatedAt != 0
+}
+
+// HasSuccessor reports whether session has stored tokens pair which isn't expired yet
+func (s *RefreshSession) HasSuccessor() bool {
+	return s.Successor != nil && time.Now().Before(s.SuccessorExpiresAt.Time())
+}
+
+// Family returns id of session family. Sessions created before families were introduced are their own family
+func (s *RefreshSession) Family() string {
+	if s.FamilyID != "" {
+		return s.FamilyID
+	}
+
+	return s.ID.Hex()
 }
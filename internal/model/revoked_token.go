@@ -0,0 +1,11 @@
+package model
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// RevokedToken is denylist entry of access token. It's kept until the token expires
+type RevokedToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	JTI       string             `bson:"jti"`
+	RevokedAt primitive.DateTime `bson:"revoked_at"`
+	ExpiresAt primitive.DateTime `bson:"expires_at"`
+}
@@ -0,0 +1,17 @@
+package model
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+const (
+	SecurityEventRefreshTokenReuse = "refresh_token_reuse"
+)
+
+type SecurityEvent struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Type      string             `bson:"type"`
+	GUID      string             `bson:"guid"`
+	FamilyID  string             `bson:"family_id,omitempty"`
+	IP        string             `bson:"ip,omitempty"`
+	Details   string             `bson:"details,omitempty"`
+	CreatedAt primitive.DateTime `bson:"created_at"`
+}
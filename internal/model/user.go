@@ -1,8 +1,63 @@
 package model
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// ScopeSessions allows to list and revoke own sessions. First-party tokens always have it,
+	// OAuth client gets it only if it's allowed to client and requested
+	ScopeSessions      = "sessions"
+	ScopeSessionsAdmin = "sessions:admin"
+	ScopeUsersAdmin    = "users:admin"
+)
+
+// privilegedScopes are scopes OAuth client gets only if user has them in Permissions
+var privilegedScopes = []string{ScopeSessionsAdmin, ScopeUsersAdmin}
+
+// User statuses. Only active users can sign in and refresh tokens. Disabled user is blocked by admin,
+// locked one is blocked temporarily, pending one hasn't been activated yet.
+// Users created before statuses were introduced don't have status and are treated as active
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+	UserStatusLocked   = "locked"
+	UserStatusPending  = "pending"
+)
+
+var userStatuses = []string{UserStatusActive, UserStatusDisabled, UserStatusLocked, UserStatusPending}
+
+func IsUserStatus(status string) bool {
+	return slices.Contains(userStatuses, status)
+}
+
+func IsPrivilegedScope(scope string) bool {
+	return slices.Contains(privilegedScopes, scope)
+}
 
 type User struct {
-	ID   primitive.ObjectID `bson:"_id,omitempty"`
-	GUID string             `bson:"guid"`
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	GUID  string             `bson:"guid"`
+	Email string             `bson:"email,omitempty"`
+	// Login and PasswordHash are optional, users without them can't sign in with password
+	Login        string `bson:"login,omitempty"`
+	PasswordHash string `bson:"password_hash,omitempty"`
+	// Roles and Permissions are embedded into access token as roles and scope claims
+	Roles       []string `bson:"roles,omitempty"`
+	Permissions []string `bson:"permissions,omitempty"`
+	Status      string   `bson:"status,omitempty"`
+	// TokenVersion is increased on security-relevant changes, tokens and sessions issued with older version are rejected
+	TokenVersion int64              `bson:"token_version,omitempty"`
+	CreatedAt    primitive.DateTime `bson:"created_at,omitempty"`
+	UpdatedAt    primitive.DateTime `bson:"updated_at,omitempty"`
+}
+
+func (u *User) IsActive() bool {
+	return u.Status == "" || u.Status == UserStatusActive
+}
+
+func (u *User) HasPermission(permission string) bool {
+	return slices.Contains(u.Permissions, permission)
 }
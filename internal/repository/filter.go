@@ -0,0 +1,8 @@
+package repository
+
+// UserFilter describes users to list. Empty fields don't filter
+type UserFilter struct {
+	Status string
+	Role   string
+	Email  string
+}
@@ -0,0 +1,74 @@
+package mongorepos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AuthorizationCodeRepository struct {
+	db *mongo.Collection
+}
+
+func NewAuthorizationCodeRepository(db *mongo.Database) *AuthorizationCodeRepository {
+	return &AuthorizationCodeRepository{
+		db: db.Collection(authCodesCollection),
+	}
+}
+
+// EnsureIndexes creates indexes used by repository. Expired codes are removed by TTL index
+func (repo *AuthorizationCodeRepository) EnsureIndexes(ctx context.Context) error {
+	const op = "internal.repository.mongorepos.authorization_code.EnsureIndexes"
+
+	_, err := repo.db.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "code_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (repo *AuthorizationCodeRepository) Insert(ctx context.Context, code model.AuthorizationCode) error {
+	const op = "internal.repository.mongorepos.authorization_code.Insert"
+
+	_, err := repo.db.InsertOne(ctx, code)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Redeem atomically finds and deletes code, so the same code can't be exchanged twice
+func (repo *AuthorizationCodeRepository) Redeem(ctx context.Context, codeHash string) (*model.AuthorizationCode, error) {
+	const op = "internal.repository.mongorepos.authorization_code.Redeem"
+
+	filter := bson.M{"code_hash": codeHash}
+
+	var code model.AuthorizationCode
+	err := repo.db.FindOneAndDelete(ctx, filter).Decode(&code)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, repository.ErrAuthCodeNotFound
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &code, nil
+}
@@ -0,0 +1,71 @@
+package mongorepos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ClientRepository struct {
+	db *mongo.Collection
+}
+
+func NewClientRepository(db *mongo.Database) *ClientRepository {
+	return &ClientRepository{
+		db: db.Collection(clientsCollection),
+	}
+}
+
+// EnsureIndexes creates unique index on client_id
+func (repo *ClientRepository) EnsureIndexes(ctx context.Context) error {
+	const op = "internal.repository.mongorepos.client.EnsureIndexes"
+
+	_, err := repo.db.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "client_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (repo *ClientRepository) FindByClientID(ctx context.Context, clientID string) (*model.Client, error) {
+	const op = "internal.repository.mongorepos.client.FindByClientID"
+
+	filter := bson.M{"client_id": clientID}
+
+	var client model.Client
+	err := repo.db.FindOne(ctx, filter).Decode(&client)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, repository.ErrClientNotFound
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &client, nil
+}
+
+// EnsureClient registers client if client with the same client_id doesn't exist. Registered client isn't changed
+func (repo *ClientRepository) EnsureClient(ctx context.Context, client model.Client) error {
+	const op = "internal.repository.mongorepos.client.EnsureClient"
+
+	filter := bson.M{"client_id": client.ClientID}
+	update := bson.M{"$setOnInsert": client}
+
+	_, err := repo.db.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
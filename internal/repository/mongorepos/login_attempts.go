@@ -0,0 +1,118 @@
+package mongorepos
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type LoginAttemptsRepository struct {
+	db *mongo.Collection
+}
+
+func NewLoginAttemptsRepository(db *mongo.Database) *LoginAttemptsRepository {
+	return &LoginAttemptsRepository{
+		db: db.Collection(loginAttemptsCollection),
+	}
+}
+
+// EnsureIndexes creates indexes used by repository. Counters are removed by TTL index once they expire
+func (repo *LoginAttemptsRepository) EnsureIndexes(ctx context.Context) error {
+	const op = "internal.repository.mongorepos.login_attempts.EnsureIndexes"
+
+	_, err := repo.db.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// FindByKeys returns counters of given keys. Keys without failures are absent in result
+func (repo *LoginAttemptsRepository) FindByKeys(ctx context.Context, keys []string) ([]model.LoginAttempts, error) {
+	const op = "internal.repository.mongorepos.login_attempts.FindByKeys"
+
+	filter := bson.M{"key": bson.M{"$in": keys}}
+
+	cursor, err := repo.db.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var attempts []model.LoginAttempts
+	err = cursor.All(ctx, &attempts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return attempts, nil
+}
+
+// AddFailure atomically increments failures counter of key, creating it if needed, and returns updated counter
+func (repo *LoginAttemptsRepository) AddFailure(ctx context.Context, key string, expiresAt time.Time) (*model.LoginAttempts, error) {
+	const op = "internal.repository.mongorepos.login_attempts.AddFailure"
+
+	filter := bson.M{"key": key}
+	update := bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$max": bson.M{"expires_at": primitive.NewDateTimeFromTime(expiresAt)},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var attempts model.LoginAttempts
+	err := repo.db.FindOneAndUpdate(ctx, filter, update, opts).Decode(&attempts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &attempts, nil
+}
+
+// Lock rejects attempts for key until given time. Counter is kept at least until lock ends
+func (repo *LoginAttemptsRepository) Lock(ctx context.Context, key string, until time.Time) error {
+	const op = "internal.repository.mongorepos.login_attempts.Lock"
+
+	filter := bson.M{"key": key}
+	update := bson.M{
+		"$max": bson.M{
+			"locked_until": primitive.NewDateTimeFromTime(until),
+			"expires_at":   primitive.NewDateTimeFromTime(until),
+		},
+	}
+
+	_, err := repo.db.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Reset removes counters of keys. Missing counters are ignored
+func (repo *LoginAttemptsRepository) Reset(ctx context.Context, keys []string) error {
+	const op = "internal.repository.mongorepos.login_attempts.Reset"
+
+	filter := bson.M{"key": bson.M{"$in": keys}}
+
+	_, err := repo.db.DeleteMany(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
@@ -3,4 +3,10 @@ package mongorepos
 const (
 	usersCollection          = "users"
 	refreshSessionCollection = "refresh_sessions"
+	sessionLocksCollection   = "refresh_session_locks"
+	securityEventCollection  = "security_events"
+	clientsCollection        = "clients"
+	authCodesCollection      = "authorization_codes"
+	revokedTokensCollection  = "revoked_tokens"
+	loginAttemptsCollection  = "login_attempts"
 )
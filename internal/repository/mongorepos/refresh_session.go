@@ -4,21 +4,71 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/4aykovksi/medods_test_task/internal/model"
 	"github.com/4aykovksi/medods_test_task/internal/repository"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sessionLockLease is time user's sessions lock is held at most, so lock of crashed instance is released
+// and sessionLockRetryInterval is how often busy lock is tried again
+const (
+	sessionLockLease         = 10 * time.Second
+	sessionLockRetryInterval = 20 * time.Millisecond
 )
 
 type RefreshSessionRepository struct {
-	db *mongo.Collection
+	db    *mongo.Collection
+	locks *mongo.Collection
 }
 
 func NewRefreshSessionsRepository(db *mongo.Database) *RefreshSessionRepository {
 	return &RefreshSessionRepository{
-		db: db.Collection(refreshSessionCollection),
+		db:    db.Collection(refreshSessionCollection),
+		locks: db.Collection(sessionLocksCollection),
+	}
+}
+
+// EnsureIndexes creates indexes used by repository. Expired sessions and locks are removed by TTL index.
+// Sessions are found by unique selector, legacy sessions without selector - by user
+func (repo *RefreshSessionRepository) EnsureIndexes(ctx context.Context) error {
+	const op = "internal.repository.mongorepos.refresh_session.EnsureIndexes"
+
+	_, err := repo.locks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "locked_until", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = repo.db.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_in", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "family_id", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "guid", Value: 1}, {Key: "last_used_at", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "selector", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"selector": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
 	}
+
+	return nil
 }
 
 func (repo *RefreshSessionRepository) Insert(ctx context.Context, session model.RefreshSession) error {
@@ -39,27 +89,122 @@ func (repo *RefreshSessionRepository) Insert(ctx context.Context, session model.
 	return nil
 }
 
-func (repo *RefreshSessionRepository) FindAllUserSessions(ctx context.Context, GUID string) ([]model.RefreshSession, error) {
-	const op = "internal.repository.mongorepos.refresh_session.FindAllUserSessions"
+// FindActiveUserSessions returns page of user's not rotated and not expired sessions sorted by last usage
+// and total count of such sessions
+func (repo *RefreshSessionRepository) FindActiveUserSessions(ctx context.Context, GUID string, offset int64, limit int64) ([]model.RefreshSession, int64, error) {
+	const op = "internal.repository.mongorepos.refresh_session.FindActiveUserSessions"
 
-	filter := bson.D{{"guid", GUID}}
+	filter := bson.M{
+		"guid":       GUID,
+		"rotated_at": bson.M{"$exists": false},
+		"expires_in": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+	}
 
-	var sessions []model.RefreshSession
-	cursor, err := repo.db.Find(ctx, filter)
+	total, err := repo.db.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "last_used_at", Value: -1}}).
+		SetSkip(offset).
+		SetLimit(limit)
+
+	cursor, err := repo.db.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	sessions := make([]model.RefreshSession, 0, limit)
+	err = cursor.All(ctx, &sessions)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return sessions, total, nil
+}
+
+func (repo *RefreshSessionRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*model.RefreshSession, error) {
+	const op = "internal.repository.mongorepos.refresh_session.FindByID"
+
+	filter := bson.M{"_id": id}
+
+	var session model.RefreshSession
+	err := repo.db.FindOne(ctx, filter).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, repository.ErrSessionNotFound
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &session, nil
+}
+
+// FindActiveByFamily returns session of family which is neither rotated nor expired
+func (repo *RefreshSessionRepository) FindActiveByFamily(ctx context.Context, familyID string) (*model.RefreshSession, error) {
+	const op = "internal.repository.mongorepos.refresh_session.FindActiveByFamily"
+
+	filter := bson.M{
+		"family_id":  familyID,
+		"rotated_at": bson.M{"$exists": false},
+		"expires_in": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+	}
+
+	var session model.RefreshSession
+	err := repo.db.FindOne(ctx, filter).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, repository.ErrSessionNotFound
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &session, nil
+}
+
+func (repo *RefreshSessionRepository) FindBySelector(ctx context.Context, selector string) (*model.RefreshSession, error) {
+	const op = "internal.repository.mongorepos.refresh_session.FindBySelector"
+
+	filter := bson.M{"selector": selector}
+
+	var session model.RefreshSession
+	err := repo.db.FindOne(ctx, filter).Decode(&session)
 	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, repository.ErrSessionNotFound
+		}
+
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	if cursor.RemainingBatchLength() == 0 {
-		return nil, repository.ErrUserSessionsNotFound
+	return &session, nil
+}
+
+// FindLegacyUserSessions returns user's not expired sessions of legacy "guid-hex" tokens, which don't have selector
+func (repo *RefreshSessionRepository) FindLegacyUserSessions(ctx context.Context, GUID string) ([]model.RefreshSession, error) {
+	const op = "internal.repository.mongorepos.refresh_session.FindLegacyUserSessions"
+
+	filter := bson.M{
+		"guid":       GUID,
+		"selector":   bson.M{"$exists": false},
+		"expires_in": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
 	}
 
+	cursor, err := repo.db.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var sessions []model.RefreshSession
 	err = cursor.All(ctx, &sessions)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return sessions, err
+	return sessions, nil
 }
 
 func (repo *RefreshSessionRepository) DeleteByToken(ctx context.Context, token string) error {
@@ -68,9 +213,221 @@ func (repo *RefreshSessionRepository) DeleteByToken(ctx context.Context, token s
 	filter := bson.D{{"refresh_token", token}}
 
 	result, err := repo.db.DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
 	if result.DeletedCount == 0 {
 		return repository.ErrSessionNotFound
 	}
+
+	return nil
+}
+
+// MarkRotated sets rotation time of session. It's single conditional update, so of concurrent calls for the same session
+// only one succeeds. ErrSessionNotFound is returned if session doesn't exist or is already rotated
+func (repo *RefreshSessionRepository) MarkRotated(ctx context.Context, id primitive.ObjectID) error {
+	const op = "internal.repository.mongorepos.refresh_session.MarkRotated"
+
+	filter := bson.M{"_id": id, "rotated_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"rotated_at": primitive.NewDateTimeFromTime(time.Now())}}
+
+	result, err := repo.db.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if result.ModifiedCount == 0 {
+		return repository.ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// SetSuccessor stores sealed tokens pair session was exchanged for until expiresAt
+func (repo *RefreshSessionRepository) SetSuccessor(ctx context.Context, id primitive.ObjectID, successor []byte, expiresAt time.Time) error {
+	const op = "internal.repository.mongorepos.refresh_session.SetSuccessor"
+
+	filter := bson.M{"_id": id}
+	update := bson.M{"$set": bson.M{
+		"successor":            successor,
+		"successor_expires_at": primitive.NewDateTimeFromTime(expiresAt),
+	}}
+
+	result, err := repo.db.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if result.MatchedCount == 0 {
+		return repository.ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// UnsetExpiredSuccessors removes expired tokens pairs from rotated sessions of family
+func (repo *RefreshSessionRepository) UnsetExpiredSuccessors(ctx context.Context, familyID string) error {
+	const op = "internal.repository.mongorepos.refresh_session.UnsetExpiredSuccessors"
+
+	filter := bson.M{
+		"family_id":            familyID,
+		"successor_expires_at": bson.M{"$lte": primitive.NewDateTimeFromTime(time.Now())},
+	}
+	update := bson.M{"$unset": bson.M{"successor": "", "successor_expires_at": ""}}
+
+	_, err := repo.db.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// DeleteExcessUserSessions keeps session with id and keep-1 other user's active sessions which were used last
+// and deletes the rest of active ones. It's called after session with id is inserted, so concurrent sign-ins can't
+// both see free slot: every insert is followed by its own trim. Trims of the same user hold user's lock,
+// so each of them sees sessions left by previous one and the last trim sees all inserted sessions
+func (repo *RefreshSessionRepository) DeleteExcessUserSessions(ctx context.Context, GUID string, id primitive.ObjectID, keep int64) error {
+	const op = "internal.repository.mongorepos.refresh_session.DeleteExcessUserSessions"
+
+	unlock, err := repo.lockUser(ctx, GUID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer unlock()
+
+	filter := bson.M{
+		"guid":       GUID,
+		"_id":        bson.M{"$ne": id},
+		"rotated_at": bson.M{"$exists": false},
+		"expires_in": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "last_used_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(max(keep-1, 0)).
+		SetProjection(bson.M{"_id": 1})
+
+	cursor, err := repo.db.Find(ctx, filter, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var excess []model.RefreshSession
+	err = cursor.All(ctx, &excess)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if len(excess) == 0 {
+		return nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(excess))
+	for _, session := range excess {
+		ids = append(ids, session.ID)
+	}
+
+	_, err = repo.db.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// lockUser takes user's sessions lock, waiting while it's held by other trim. Lock document is taken
+// with single conditional update: it's inserted if absent or taken over if its lease is over, and insert
+// of held lock fails on duplicate _id. Returned function releases the lock
+func (repo *RefreshSessionRepository) lockUser(ctx context.Context, GUID string) (func(), error) {
+	const op = "internal.repository.mongorepos.refresh_session.lockUser"
+
+	owner := primitive.NewObjectID()
+
+	ticker := time.NewTicker(sessionLockRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		filter := bson.M{
+			"_id":          GUID,
+			"locked_until": bson.M{"$lte": primitive.NewDateTimeFromTime(now)},
+		}
+		update := bson.M{"$set": bson.M{
+			"owner":        owner,
+			"locked_until": primitive.NewDateTimeFromTime(now.Add(sessionLockLease)),
+		}}
+
+		_, err := repo.locks.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s: %w", op, ctx.Err())
+		}
+	}
+
+	return func() {
+		// lock is released even if request is canceled, otherwise user waits for lease to end
+		_, _ = repo.locks.DeleteOne(context.WithoutCancel(ctx), bson.M{"_id": GUID, "owner": owner})
+	}, nil
+}
+
+func (repo *RefreshSessionRepository) DeleteByFamily(ctx context.Context, familyID string) error {
+	const op = "internal.repository.mongorepos.refresh_session.DeleteByFamily"
+
+	filter := bson.M{"family_id": familyID}
+
+	_, err := repo.db.DeleteMany(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (repo *RefreshSessionRepository) DeleteByID(ctx context.Context, id primitive.ObjectID) error {
+	const op = "internal.repository.mongorepos.refresh_session.DeleteByID"
+
+	filter := bson.M{"_id": id}
+
+	result, err := repo.db.DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if result.DeletedCount == 0 {
+		return repository.ErrSessionNotFound
+	}
+
+	return nil
+}
+
+func (repo *RefreshSessionRepository) DeleteAllUserSessions(ctx context.Context, GUID string) error {
+	const op = "internal.repository.mongorepos.refresh_session.DeleteAllUserSessions"
+
+	filter := bson.M{"guid": GUID}
+
+	_, err := repo.db.DeleteMany(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// DeleteAllUserSessionsExcept deletes user's sessions except session with id and sessions of family familyID
+func (repo *RefreshSessionRepository) DeleteAllUserSessionsExcept(ctx context.Context, GUID string, id primitive.ObjectID, familyID string) error {
+	const op = "internal.repository.mongorepos.refresh_session.DeleteAllUserSessionsExcept"
+
+	filter := bson.M{
+		"guid":      GUID,
+		"_id":       bson.M{"$ne": id},
+		"family_id": bson.M{"$ne": familyID},
+	}
+
+	_, err := repo.db.DeleteMany(ctx, filter)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
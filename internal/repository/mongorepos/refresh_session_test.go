@@ -0,0 +1,177 @@
+package mongorepos
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMarkRotatedSucceedsOnce(t *testing.T) {
+	const requests = 16
+
+	repo := newTestSessionRepository(t)
+	session := newTestSession("user", time.Hour)
+	if err := repo.Insert(context.Background(), session); err != nil {
+		t.Fatalf("can't insert session: %v", err)
+	}
+
+	start := make(chan struct{})
+	errs := make(chan error, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			<-start
+			errs <- repo.MarkRotated(context.Background(), session.ID)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	rotated := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			rotated++
+		case errors.Is(err, repository.ErrSessionNotFound):
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	if rotated != 1 {
+		t.Fatalf("session rotated %d times, want 1", rotated)
+	}
+}
+
+func TestDeleteExcessUserSessionsKeepsInsertedSession(t *testing.T) {
+	const keep = 2
+
+	repo := newTestSessionRepository(t)
+	for i := 0; i < keep; i++ {
+		if err := repo.Insert(context.Background(), newTestSession("user", time.Hour)); err != nil {
+			t.Fatalf("can't insert session: %v", err)
+		}
+	}
+
+	// client with shorter refresh TTL signs in, its session expires before the others
+	session := newTestSession("user", time.Minute)
+	if err := repo.Insert(context.Background(), session); err != nil {
+		t.Fatalf("can't insert session: %v", err)
+	}
+	if err := repo.DeleteExcessUserSessions(context.Background(), "user", session.ID, keep); err != nil {
+		t.Fatalf("can't delete excess sessions: %v", err)
+	}
+
+	if _, err := repo.FindByID(context.Background(), session.ID); err != nil {
+		t.Fatalf("inserted session is evicted: %v", err)
+	}
+	if total := countActiveSessions(t, repo, "user"); total != keep {
+		t.Fatalf("user has %d active sessions, want %d", total, keep)
+	}
+}
+
+func TestDeleteExcessUserSessionsLimitsConcurrentSignIns(t *testing.T) {
+	const (
+		requests = 16
+		keep     = 3
+	)
+
+	repo := newTestSessionRepository(t)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			<-start
+			session := newTestSession("user", time.Hour)
+			if err := repo.Insert(context.Background(), session); err != nil {
+				t.Errorf("can't insert session: %v", err)
+				return
+			}
+			if err := repo.DeleteExcessUserSessions(context.Background(), "user", session.ID, keep); err != nil {
+				t.Errorf("can't delete excess sessions: %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if total := countActiveSessions(t, repo, "user"); total > keep {
+		t.Fatalf("user has %d active sessions, want at most %d", total, keep)
+	}
+}
+
+// newTestSessionRepository returns repository of fresh database which is dropped after test.
+// Mongo is found by MONGODB_URI, test is skipped if it isn't set
+func newTestSessionRepository(t *testing.T) *RefreshSessionRepository {
+	t.Helper()
+
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI isn't set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("can't connect to mongo: %v", err)
+	}
+
+	db := client.Database("medods_test_task_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		_ = db.Drop(context.Background())
+		_ = client.Disconnect(context.Background())
+	})
+
+	repo := NewRefreshSessionsRepository(db)
+	if err := repo.EnsureIndexes(ctx); err != nil {
+		t.Fatalf("can't create indexes: %v", err)
+	}
+
+	return repo
+}
+
+func newTestSession(GUID string, ttl time.Duration) model.RefreshSession {
+	now := time.Now()
+	id := primitive.NewObjectID()
+
+	return model.RefreshSession{
+		ID:           id,
+		GUID:         GUID,
+		FamilyID:     id.Hex(),
+		Selector:     id.Hex(),
+		RefreshToken: "verifier",
+		CreatedAt:    primitive.NewDateTimeFromTime(now),
+		LastUsedAt:   primitive.NewDateTimeFromTime(now),
+		ExpiresIn:    primitive.NewDateTimeFromTime(now.Add(ttl)),
+	}
+}
+
+func countActiveSessions(t *testing.T, repo *RefreshSessionRepository, GUID string) int64 {
+	t.Helper()
+
+	_, total, err := repo.FindActiveUserSessions(context.Background(), GUID, 0, 1)
+	if err != nil {
+		t.Fatalf("can't count sessions: %v", err)
+	}
+
+	return total
+}
@@ -0,0 +1,71 @@
+package mongorepos
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type RevokedTokenRepository struct {
+	db *mongo.Collection
+}
+
+func NewRevokedTokenRepository(db *mongo.Database) *RevokedTokenRepository {
+	return &RevokedTokenRepository{
+		db: db.Collection(revokedTokensCollection),
+	}
+}
+
+// EnsureIndexes creates indexes used by repository. Entries of expired tokens are removed by TTL index
+func (repo *RevokedTokenRepository) EnsureIndexes(ctx context.Context) error {
+	const op = "internal.repository.mongorepos.revoked_token.EnsureIndexes"
+
+	_, err := repo.db.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "jti", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Insert adds token to denylist. Revoking already revoked token isn't an error
+func (repo *RevokedTokenRepository) Insert(ctx context.Context, token model.RevokedToken) error {
+	const op = "internal.repository.mongorepos.revoked_token.Insert"
+
+	_, err := repo.db.InsertOne(ctx, token)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (repo *RevokedTokenRepository) Exists(ctx context.Context, jti string) (bool, error) {
+	const op = "internal.repository.mongorepos.revoked_token.Exists"
+
+	filter := bson.M{"jti": jti}
+
+	count, err := repo.db.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return count > 0, nil
+}
@@ -0,0 +1,30 @@
+package mongorepos
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type SecurityEventRepository struct {
+	db *mongo.Collection
+}
+
+func NewSecurityEventRepository(db *mongo.Database) *SecurityEventRepository {
+	return &SecurityEventRepository{
+		db: db.Collection(securityEventCollection),
+	}
+}
+
+func (repo *SecurityEventRepository) Insert(ctx context.Context, event model.SecurityEvent) error {
+	const op = "internal.repository.mongorepos.security_event.Insert"
+
+	_, err := repo.db.InsertOne(ctx, event)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
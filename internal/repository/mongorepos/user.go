@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/4aykovksi/medods_test_task/internal/model"
 	"github.com/4aykovksi/medods_test_task/internal/repository"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type UserRepository struct {
@@ -21,6 +24,47 @@ func NewUserRepository(db *mongo.Database) *UserRepository {
 	}
 }
 
+// EnsureIndexes creates unique indexes on guid and login. Users without login aren't indexed by login
+func (repo *UserRepository) EnsureIndexes(ctx context.Context) error {
+	const op = "internal.repository.mongorepos.user.EnsureIndexes"
+
+	_, err := repo.db.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "login", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"login": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "guid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (repo *UserRepository) FindByLogin(ctx context.Context, login string) (*model.User, error) {
+	const op = "internal.repository.mongorepos.user.FindByLogin"
+
+	filter := bson.M{"login": login}
+
+	var user model.User
+	err := repo.db.FindOne(ctx, filter).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, repository.ErrUserNotFound
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &user, nil
+}
+
 func (repo *UserRepository) FindByGUID(ctx context.Context, guid string) (*model.User, error) {
 	const op = "internal.repository.mongorepos.user.FindByGUID"
 
@@ -38,3 +82,167 @@ func (repo *UserRepository) FindByGUID(ctx context.Context, guid string) (*model
 
 	return &user, nil
 }
+
+func (repo *UserRepository) Insert(ctx context.Context, user model.User) error {
+	const op = "internal.repository.mongorepos.user.Insert"
+
+	_, err := repo.db.InsertOne(ctx, user)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return repository.ErrUserAlreadyExists
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// List returns up to limit users matching filter with _id greater than after, sorted by _id
+func (repo *UserRepository) List(ctx context.Context, filter repository.UserFilter, after primitive.ObjectID, limit int64) ([]model.User, error) {
+	const op = "internal.repository.mongorepos.user.List"
+
+	query := bson.M{}
+	if filter.Status == model.UserStatusActive {
+		// users without status are active too
+		query["status"] = bson.M{"$in": bson.A{model.UserStatusActive, nil}}
+	} else if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if filter.Role != "" {
+		query["roles"] = filter.Role
+	}
+	if filter.Email != "" {
+		query["email"] = filter.Email
+	}
+	if !after.IsZero() {
+		query["_id"] = bson.M{"$gt": after}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit)
+
+	cursor, err := repo.db.Find(ctx, query, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	users := make([]model.User, 0, limit)
+	err = cursor.All(ctx, &users)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return users, nil
+}
+
+// Update changes only fields of update in single atomic operation, so concurrent updates of other fields aren't
+// overwritten, and returns updated user. ErrUserModified is returned if token version doesn't match IfTokenVersion
+func (repo *UserRepository) Update(ctx context.Context, GUID string, update repository.UserUpdate) (*model.User, error) {
+	const op = "internal.repository.mongorepos.user.Update"
+
+	filter := bson.M{"guid": GUID}
+	if update.IfTokenVersion != nil {
+		if *update.IfTokenVersion == 0 {
+			// zero version isn't stored
+			filter["token_version"] = bson.M{"$in": bson.A{0, nil}}
+		} else {
+			filter["token_version"] = *update.IfTokenVersion
+		}
+	}
+
+	set := bson.M{"updated_at": primitive.NewDateTimeFromTime(time.Now())}
+	unset := bson.M{}
+	setField := func(field string, value any, empty bool) {
+		if empty {
+			unset[field] = ""
+		} else {
+			set[field] = value
+		}
+	}
+	if update.Login != nil {
+		setField("login", *update.Login, *update.Login == "")
+	}
+	if update.Email != nil {
+		setField("email", *update.Email, *update.Email == "")
+	}
+	if update.PasswordHash != nil {
+		setField("password_hash", *update.PasswordHash, *update.PasswordHash == "")
+	}
+	if update.Roles != nil {
+		setField("roles", *update.Roles, len(*update.Roles) == 0)
+	}
+	if update.Permissions != nil {
+		setField("permissions", *update.Permissions, len(*update.Permissions) == 0)
+	}
+	if update.Status != nil {
+		setField("status", *update.Status, *update.Status == "")
+	}
+
+	change := bson.M{"$set": set}
+	if len(unset) > 0 {
+		change["$unset"] = unset
+	}
+	if update.IncTokenVersion {
+		change["$inc"] = bson.M{"token_version": 1}
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user model.User
+	err := repo.db.FindOneAndUpdate(ctx, filter, change, opts).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			if update.IfTokenVersion != nil {
+				return nil, repository.ErrUserModified
+			}
+
+			return nil, repository.ErrUserNotFound
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, repository.ErrUserAlreadyExists
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &user, nil
+}
+
+func (repo *UserRepository) Delete(ctx context.Context, GUID string) error {
+	const op = "internal.repository.mongorepos.user.Delete"
+
+	filter := bson.M{"guid": GUID}
+
+	res, err := repo.db.DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if res.DeletedCount == 0 {
+		return repository.ErrUserNotFound
+	}
+
+	return nil
+}
+
+// UpdatePasswordHash replaces password hash only if it's still oldHash, so concurrent password change isn't overwritten.
+// ErrUserNotFound is returned if user doesn't exist or hash was changed
+func (repo *UserRepository) UpdatePasswordHash(ctx context.Context, GUID string, oldHash string, newHash string) error {
+	const op = "internal.repository.mongorepos.user.UpdatePasswordHash"
+
+	filter := bson.M{"guid": GUID, "password_hash": oldHash}
+	update := bson.M{"$set": bson.M{"password_hash": newHash}}
+
+	res, err := repo.db.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if res.MatchedCount == 0 {
+		return repository.ErrUserNotFound
+	}
+
+	return nil
+}
@@ -4,7 +4,10 @@ import "errors"
 
 var (
 	ErrUserNotFound         = errors.New("user not found")
+	ErrUserAlreadyExists    = errors.New("user with the same guid or login already exists")
+	ErrUserModified         = errors.New("user was modified concurrently")
 	ErrSessionAlreadyExists = errors.New("refresh session already exists")
 	ErrSessionNotFound      = errors.New("refresh session not found")
-	ErrUserSessionsNotFound = errors.New("user doesn't have refresh sessions")
+	ErrClientNotFound       = errors.New("client not found")
+	ErrAuthCodeNotFound     = errors.New("authorization code not found")
 )
@@ -0,0 +1,16 @@
+package repository
+
+// UserUpdate describes change of user. Nil fields are kept, empty ones are removed.
+// Token version is increased if IncTokenVersion is set. If IfTokenVersion isn't nil, user is updated
+// only while its token version is still equal to it
+type UserUpdate struct {
+	Login        *string
+	Email        *string
+	PasswordHash *string
+	Roles        *[]string
+	Permissions  *[]string
+	Status       *string
+
+	IncTokenVersion bool
+	IfTokenVersion  *int64
+}
@@ -6,27 +6,49 @@ import (
 	"errors"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"github.com/4aykovksi/medods_test_task/internal/rest/v1/middleware"
 	"github.com/4aykovksi/medods_test_task/internal/services"
 	"github.com/4aykovksi/medods_test_task/pkg/lib/api/response"
 	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/hasher"
 )
 
 const (
 	GuidNotSpecifiedMsg    = "guid wasn't specified"
+	CredNotSpecifiedMsg    = "login and password must be specified"
 	TokenNotSpecifiedMsg   = "refresh token is not specified"
+	AccessNotSpecifiedMsg  = "access token is not specified"
 	WrongCredentialsMsg    = "wrong credentials"
 	InternalServerErrorMsg = "internal server error"
+	MethodNotAllowedMsg    = "method not allowed"
+	InvalidClientMsg       = "unknown client"
+	UnauthorizedClientMsg  = "client isn't allowed to sign in"
+	PasswordRequiredMsg    = "user must sign in with login and password"
+	UserDisabledMsg        = "user is disabled"
+	UserLockedMsg          = "user is locked"
+	UserPendingMsg         = "user isn't activated"
+	UserDisabledCode       = "user_disabled"
+	UserLockedCode         = "user_locked"
+	UserPendingCode        = "user_pending"
+	TooManyAttemptsMsg     = "too many failed attempts, try again later"
+	ServerBusyMsg          = "server is busy, try again later"
+	busyRetryAfter         = "1"
 	refreshCookieName      = "refreshToken"
 	refreshCookiePath      = "/api/v1/auth"
 )
 
 type authService interface {
 	SignIn(ctx context.Context, input services.AuthSignInInput) (*auth.Tokens, error)
-	Refresh(ctx context.Context, base64token string) (*auth.Tokens, error)
+	Refresh(ctx context.Context, input services.AuthRefreshInput) (*auth.Tokens, error)
+	Logout(ctx context.Context, base64token string) error
+	LogoutAll(ctx context.Context, base64token string) error
+	LogoutOthers(ctx context.Context, base64token string) error
 }
 
 type AuthHandler struct {
@@ -47,11 +69,23 @@ type authSignInOutput struct {
 	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
-// SignIn handles sign in requests
+type authSignInInput struct {
+	Login       string `json:"login"`
+	Password    string `json:"password"`
+	ClientID    string `json:"client_id,omitempty"`
+	DeviceLabel string `json:"device_label,omitempty"`
+}
+
+// SignIn handles sign in requests. POST takes JSON body with login and password,
+// GET takes guid query parameter. client_id identifies first-party application, default client is used without it
 // 200 - OK. response contains access and refresh tokens, refresh cookies is set
-// 400 - guid is not specified.
-// 407 - can't find given guid in database
+// 400 - guid or login and password are not specified or client is unknown or isn't specified without default one
+// 403 - client isn't allowed to sign in, user with password signs in by guid or user isn't active, code in body tells user's status
+// 405 - method is neither GET nor POST
+// 407 - can't find given guid in database or login and password don't match
+// 429 - too many failed attempts for user or IP, Retry-After header tells when to retry
 // 500 - various internal server errors
+// 503 - server is too busy to check password
 func (h *AuthHandler) SignIn(log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "rest.v1.handler.auth.SignIn"
@@ -62,22 +96,68 @@ func (h *AuthHandler) SignIn(log *slog.Logger) http.HandlerFunc {
 
 		w.Header().Set("Content-Type", "application/json")
 
-		guid := r.URL.Query().Get("guid")
-		if guid == "" {
-			log.Info("token wasn't specified")
+		input := services.AuthSignInInput{
+			IP:        clientIP(r),
+			UserAgent: r.UserAgent(),
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			var req authSignInInput
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Login == "" || req.Password == "" {
+				log.Info("login or password wasn't specified")
+
+				sendErrorResponse(log, w, CredNotSpecifiedMsg, http.StatusBadRequest)
+				return
+			}
+
+			input.Login = req.Login
+			input.Password = req.Password
+			input.ClientID = req.ClientID
+			input.DeviceLabel = req.DeviceLabel
+		case http.MethodGet:
+			input.GUID = r.URL.Query().Get("guid")
+			if input.GUID == "" {
+				log.Info("token wasn't specified")
+
+				sendErrorResponse(log, w, GuidNotSpecifiedMsg, http.StatusBadRequest)
+				return
+			}
 
-			sendErrorResponse(log, w, GuidNotSpecifiedMsg, http.StatusBadRequest)
+			input.ClientID = r.URL.Query().Get("client_id")
+			input.DeviceLabel = r.URL.Query().Get("device_label")
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
 			return
 		}
 
-		tokens, err := h.authService.SignIn(r.Context(), services.AuthSignInInput{GUID: guid})
+		tokens, err := h.authService.SignIn(r.Context(), input)
 		if err != nil {
-			if errors.Is(err, repository.ErrUserNotFound) {
+			if sendTooManyAttemptsError(log, w, err) {
+				return
+			}
+			if errors.Is(err, repository.ErrUserNotFound) || errors.Is(err, services.ErrWrongCred) {
 				log.Info("wrong credentials")
 
 				sendErrorResponse(log, w, WrongCredentialsMsg, http.StatusProxyAuthRequired)
 				return
 			}
+			if errors.Is(err, services.ErrPasswordRequired) {
+				log.Info("user with password tried to sign in by guid", slog.String("guid", input.GUID))
+
+				sendErrorResponse(log, w, PasswordRequiredMsg, http.StatusForbidden)
+				return
+			}
+			if sendClientError(log, w, err) {
+				return
+			}
+			if sendUserStatusError(log, w, err) {
+				return
+			}
+			if sendBusyError(log, w, err) {
+				return
+			}
 
 			log.Error("internal error on authService.SignIn", slog.String("err", err.Error()))
 
@@ -88,7 +168,7 @@ func (h *AuthHandler) SignIn(log *slog.Logger) http.HandlerFunc {
 		refreshCookie := h.newRefreshCookie(tokens.RefreshToken, tokens.ExpiresIn)
 		http.SetCookie(w, refreshCookie)
 
-		log.Info("successfully signed in", slog.String("login", guid))
+		log.Info("successfully signed in", slog.String("guid", input.GUID), slog.String("login", input.Login))
 
 		res := authSignInOutput{
 			Response:     response.OK(),
@@ -106,7 +186,9 @@ func (h *AuthHandler) SignIn(log *slog.Logger) http.HandlerFunc {
 }
 
 type authRefreshInput struct {
+	AccessToken  string `json:"access_token,omitempty"`
 	RefreshToken string `json:"refresh_token,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
 }
 
 type authRefreshOutput struct {
@@ -115,11 +197,17 @@ type authRefreshOutput struct {
 	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
-// Refresh handles refresh request
+// Refresh handles refresh request.
+// Access token is taken from Authorization header or body, refresh token - from cookie or body.
+// Legacy "guid-hex" refresh token is accepted without access token until it expires.
+// Session of first-party application is refreshed only with the same client_id in body, default client is used without it
 // 200 - OK. response contains access and refresh tokens, refresh cookies is set
-// 400 - refresh token is not specified.
-// 407 - refresh token wasn't find or it's not valid
+// 400 - access or refresh token is not specified or client is unknown or isn't specified without default one
+// 403 - client isn't allowed to sign in or user isn't active, code in body tells user's status
+// 407 - refresh token wasn't find, it's not valid or it wasn't issued with given access token
+// 429 - too many failed attempts for user, IP or token, Retry-After header tells when to retry
 // 500 - various internal server errors
+// 503 - server is too busy to check refresh token
 func (h *AuthHandler) Refresh(log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "rest.v1.handler.auth.Refresh"
@@ -130,37 +218,71 @@ func (h *AuthHandler) Refresh(log *slog.Logger) http.HandlerFunc {
 
 		w.Header().Set("Content-Type", "application/json")
 
-		var token string
-		cookie, err := r.Cookie(refreshCookieName)
+		var req authRefreshInput
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			var req authRefreshInput
-			body, err := io.ReadAll(r.Body)
-			if err != nil {
-				log.Error("can't decode request body", slog.String("err", err.Error()))
+			log.Error("can't decode request body", slog.String("err", err.Error()))
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+		if len(body) > 0 {
+			// tokens may be passed in cookie and header only, so body is optional
+			_ = json.Unmarshal(body, &req)
+		}
+
+		if cookie, err := r.Cookie(refreshCookieName); err == nil {
+			req.RefreshToken = cookie.Value
+		}
+		if req.RefreshToken == "" {
+			log.Info("refresh token is not specified")
+
+			sendErrorResponse(log, w, TokenNotSpecifiedMsg, http.StatusBadRequest)
+			return
+		}
+
+		if accessToken := middleware.BearerToken(r); accessToken != "" {
+			req.AccessToken = accessToken
+		}
 
-				sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+		tokens, err := h.authService.Refresh(r.Context(), services.AuthRefreshInput{
+			AccessToken:  req.AccessToken,
+			RefreshToken: req.RefreshToken,
+			ClientID:     req.ClientID,
+			IP:           clientIP(r),
+			UserAgent:    r.UserAgent(),
+		})
+		if err != nil {
+			if sendTooManyAttemptsError(log, w, err) {
 				return
 			}
-			err = json.Unmarshal(body, &req)
-			if err != nil || req.RefreshToken == "" {
-				log.Info("refresh_cookie is not specified")
+			if errors.Is(err, services.ErrAccessTokenRequired) {
+				log.Info("access token is not specified")
 
-				sendErrorResponse(log, w, TokenNotSpecifiedMsg, http.StatusBadRequest)
+				sendErrorResponse(log, w, AccessNotSpecifiedMsg, http.StatusBadRequest)
 				return
 			}
-			token = req.RefreshToken
-		} else {
-			token = cookie.Value
-		}
+			if errors.Is(err, services.ErrTokenReused) {
+				log.Warn("refresh token reuse detected, session family is revoked")
 
-		tokens, err := h.authService.Refresh(r.Context(), token)
-		if err != nil {
+				sendErrorResponse(log, w, WrongCredentialsMsg, http.StatusProxyAuthRequired)
+				return
+			}
 			if errors.Is(err, services.ErrWrongCred) {
 				log.Info("wrong credentials")
 
 				sendErrorResponse(log, w, WrongCredentialsMsg, http.StatusProxyAuthRequired)
 				return
 			}
+			if sendClientError(log, w, err) {
+				return
+			}
+			if sendUserStatusError(log, w, err) {
+				return
+			}
+			if sendBusyError(log, w, err) {
+				return
+			}
 			log.Error("internal server error", slog.String("err", err.Error()))
 
 			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
@@ -188,6 +310,103 @@ func (h *AuthHandler) Refresh(log *slog.Logger) http.HandlerFunc {
 
 }
 
+type authLogoutInput struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// Logout handles request to revoke session of refresh token
+// 200 - OK. session is revoked, refresh cookie is cleared
+// 400 - refresh token is not specified.
+// 405 - method is not POST
+// 407 - refresh token wasn't find or it's not valid
+// 500 - various internal server errors
+func (h *AuthHandler) Logout(log *slog.Logger) http.HandlerFunc {
+	return h.logout(log, "rest.v1.handler.auth.Logout", h.authService.Logout, true)
+}
+
+// LogoutAll handles request to revoke every session of the user, including current one
+// Responses are the same as Logout ones
+func (h *AuthHandler) LogoutAll(log *slog.Logger) http.HandlerFunc {
+	return h.logout(log, "rest.v1.handler.auth.LogoutAll", h.authService.LogoutAll, true)
+}
+
+// LogoutOthers handles request to revoke every session of the user except current one. Refresh cookie is kept
+// Responses are the same as Logout ones
+func (h *AuthHandler) LogoutOthers(log *slog.Logger) http.HandlerFunc {
+	return h.logout(log, "rest.v1.handler.auth.LogoutOthers", h.authService.LogoutOthers, false)
+}
+
+func (h *AuthHandler) logout(
+	log *slog.Logger,
+	op string,
+	revoke func(ctx context.Context, base64token string) error,
+	clearCookie bool,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		var token string
+		cookie, err := r.Cookie(refreshCookieName)
+		if err != nil {
+			var req authLogoutInput
+			err = json.NewDecoder(r.Body).Decode(&req)
+			if err != nil || req.RefreshToken == "" {
+				log.Info("refresh token is not specified")
+
+				sendErrorResponse(log, w, TokenNotSpecifiedMsg, http.StatusBadRequest)
+				return
+			}
+			token = req.RefreshToken
+		} else {
+			token = cookie.Value
+		}
+
+		err = revoke(r.Context(), token)
+		if err != nil {
+			if errors.Is(err, services.ErrWrongCred) {
+				log.Info("wrong credentials")
+
+				sendErrorResponse(log, w, WrongCredentialsMsg, http.StatusProxyAuthRequired)
+				return
+			}
+			if sendClientError(log, w, err) {
+				return
+			}
+			if sendBusyError(log, w, err) {
+				return
+			}
+			log.Error("internal server error", slog.String("err", err.Error()))
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		if clearCookie {
+			refreshCookie := h.newRefreshCookie("", time.Unix(0, 0))
+			refreshCookie.MaxAge = -1
+			http.SetCookie(w, refreshCookie)
+		}
+
+		log.Info("successfully logged out")
+
+		jsonRes, err := json.Marshal(response.OK())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonRes)
+	}
+}
+
 func (h *AuthHandler) newRefreshCookie(refreshToken string, time time.Time) *http.Cookie {
 	return &http.Cookie{
 		Name:    refreshCookieName,
@@ -201,6 +420,99 @@ func (h *AuthHandler) newRefreshCookie(refreshToken string, time time.Time) *htt
 	}
 }
 
+// clientIP returns IP address of the connection the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// sendClientError sends response for client related errors of authService. It returns false if err isn't one of them
+func sendClientError(log *slog.Logger, w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, services.ErrInvalidClient):
+		log.Info("unknown client")
+
+		sendErrorResponse(log, w, InvalidClientMsg, http.StatusBadRequest)
+	case errors.Is(err, services.ErrUnauthorizedClient):
+		log.Info("client isn't allowed to sign in")
+
+		sendErrorResponse(log, w, UnauthorizedClientMsg, http.StatusForbidden)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// sendUserStatusError sends response for errors of authService returned for user who isn't active.
+// It returns false if err isn't one of them
+func sendUserStatusError(log *slog.Logger, w http.ResponseWriter, err error) bool {
+	var msg, code string
+	switch {
+	case errors.Is(err, services.ErrUserDisabled):
+		msg, code = UserDisabledMsg, UserDisabledCode
+	case errors.Is(err, services.ErrUserLocked):
+		msg, code = UserLockedMsg, UserLockedCode
+	case errors.Is(err, services.ErrUserPending):
+		msg, code = UserPendingMsg, UserPendingCode
+	default:
+		return false
+	}
+
+	log.Info("user isn't active", slog.String("code", code))
+
+	w.WriteHeader(http.StatusForbidden)
+	jsonRes, err := json.Marshal(response.ErrorWithCode(msg, code))
+	if err != nil {
+		log.Error("internal error on marshalling response", slog.String("err", err.Error()))
+		return true
+	}
+	w.Write(jsonRes)
+
+	return true
+}
+
+// sendTooManyAttemptsError sends 429 with Retry-After header for throttled attempt. It returns false if err isn't ErrTooManyAttempts
+func sendTooManyAttemptsError(log *slog.Logger, w http.ResponseWriter, err error) bool {
+	if !setRetryAfter(w, err) {
+		return false
+	}
+
+	log.Info("too many failed attempts")
+
+	sendErrorResponse(log, w, TooManyAttemptsMsg, http.StatusTooManyRequests)
+	return true
+}
+
+// setRetryAfter sets Retry-After header in seconds if err is *services.TooManyAttemptsError
+func setRetryAfter(w http.ResponseWriter, err error) bool {
+	var tooMany *services.TooManyAttemptsError
+	if !errors.As(err, &tooMany) {
+		return false
+	}
+
+	seconds := (tooMany.RetryAfter + time.Second - 1) / time.Second
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	return true
+}
+
+// sendBusyError sends 503 if request was rejected because all hashing workers are busy. It returns false otherwise
+func sendBusyError(log *slog.Logger, w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, hasher.ErrBusy) {
+		return false
+	}
+
+	log.Warn("hasher is busy, request rejected")
+
+	w.Header().Set("Retry-After", busyRetryAfter)
+	sendErrorResponse(log, w, ServerBusyMsg, http.StatusServiceUnavailable)
+	return true
+}
+
 // sendErrorResponse send response with given statusCode as http status code and msg in body
 func sendErrorResponse(log *slog.Logger, w http.ResponseWriter, msg string, statusCode int) {
 	w.WriteHeader(statusCode)
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+)
+
+const jwksCacheControl = "public, max-age=300"
+
+type keySetProvider interface {
+	JWKS() auth.JWKS
+}
+
+type JWKSHandler struct {
+	keys keySetProvider
+}
+
+func NewJWKSHandler(
+	keys keySetProvider,
+) *JWKSHandler {
+	return &JWKSHandler{
+		keys: keys,
+	}
+}
+
+// JWKS handles requests for public keys used to verify access tokens
+// 200 - OK. response contains RFC 7517 JSON Web Key Set
+// 405 - method is not GET
+// 500 - various internal server errors
+func (h *JWKSHandler) JWKS(log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "rest.v1.handler.jwks.JWKS"
+
+		log := log.With(slog.String("op", op))
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		jsonRes, err := json.Marshal(h.keys.JWKS())
+		if err != nil {
+			log.Error("internal error on marshalling jwks", slog.String("err", err.Error()))
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", jwksCacheControl)
+		w.Write(jsonRes)
+	}
+}
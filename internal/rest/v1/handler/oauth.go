@@ -0,0 +1,612 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/rest/v1/middleware"
+	"github.com/4aykovksi/medods_test_task/internal/services"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/hasher"
+)
+
+// OAuth 2.0 error codes, RFC 6749 section 5.2
+const (
+	oauthInvalidRequest       = "invalid_request"
+	oauthInvalidClient        = "invalid_client"
+	oauthInvalidGrant         = "invalid_grant"
+	oauthUnsupportedGrantType = "unsupported_grant_type"
+	oauthInvalidScope         = "invalid_scope"
+	oauthUnauthorizedClient   = "unauthorized_client"
+	oauthUnsupportedResponse  = "unsupported_response_type"
+	oauthAccessDenied         = "access_denied"
+	oauthServerError          = "server_error"
+	oauthTemporarilyUnavail   = "temporarily_unavailable"
+)
+
+const (
+	grantTypeAuthorizationCode = model.GrantAuthorizationCode
+	grantTypeRefreshToken      = model.GrantRefreshToken
+	grantTypeClientCredentials = model.GrantClientCredentials
+	responseTypeCode           = "code"
+	tokenTypeBearer            = "Bearer"
+)
+
+type oauthAuthService interface {
+	Refresh(ctx context.Context, input services.AuthRefreshInput) (*auth.Tokens, error)
+	ClientCredentials(ctx context.Context, client *model.Client, scopes []string) (*auth.Tokens, error)
+	Authorize(ctx context.Context, input services.AuthAuthorizeInput) (string, error)
+	ExchangeCode(ctx context.Context, input services.AuthExchangeCodeInput) (*auth.Tokens, error)
+	Introspect(ctx context.Context, token string, hint string) (*services.Introspection, error)
+	Revoke(ctx context.Context, client *model.Client, token string, hint string) error
+}
+
+type clientService interface {
+	Authenticate(ctx context.Context, clientID string, secret string) (*model.Client, error)
+	FindClient(ctx context.Context, clientID string) (*model.Client, error)
+}
+
+type OAuthHandler struct {
+	authService   oauthAuthService
+	clientService clientService
+}
+
+func NewOAuthHandler(
+	authService oauthAuthService,
+	clientService clientService,
+) *OAuthHandler {
+	return &OAuthHandler{
+		authService:   authService,
+		clientService: clientService,
+	}
+}
+
+// oauthTokenOutput is successful token response, RFC 6749 section 5.1
+type oauthTokenOutput struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// introspectionOutput is introspection response, RFC 7662 section 2.2
+type introspectionOutput struct {
+	Active    bool   `json:"active"`
+	TokenType string `json:"token_type,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// oauthErrorOutput is error response, RFC 6749 section 5.2
+type oauthErrorOutput struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// Authorize issues OAuth 2.0 authorization code to client on behalf of user signed in to first-party application.
+// It isn't RFC 6749 section 3.1 authorization endpoint: user is authenticated with bearer access token, so browser
+// can't be redirected here. First-party application calls it after user consented and navigates browser to Location.
+// Only code response type with PKCE S256 is supported. Parameters are read from query or form-encoded body
+// 302 - redirect to client redirect_uri with code and state or with error, RFC 6749 section 4.1.2
+// 400 - client_id is unknown or redirect_uri isn't registered for client, user isn't redirected in this case
+// 500 - various internal server errors before redirect_uri is validated
+func (h *OAuthHandler) Authorize(log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "rest.v1.handler.oauth.Authorize"
+
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			sendOAuthError(log, w, oauthInvalidRequest, "invalid request parameters", http.StatusBadRequest)
+			return
+		}
+
+		subject, ok := middleware.SubjectFromContext(r.Context())
+		if !ok {
+			log.Error("request isn't authenticated")
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		clientID := r.Form.Get("client_id")
+		client, err := h.clientService.FindClient(r.Context(), clientID)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidClient) {
+				log.Info("unknown client", slog.String("client_id", clientID))
+
+				sendOAuthError(log, w, oauthInvalidRequest, "unknown client_id", http.StatusBadRequest)
+				return
+			}
+
+			log.Error("internal error on clientService.FindClient", slog.String("err", err.Error()))
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		// errors are sent to client only after redirect URI is checked, otherwise it's an open redirect
+		redirectURI, ok := client.RedirectURI(r.Form.Get("redirect_uri"))
+		if !ok {
+			log.Info("redirect uri isn't registered", slog.String("client_id", clientID))
+
+			sendOAuthError(log, w, oauthInvalidRequest, "redirect_uri isn't registered for client", http.StatusBadRequest)
+			return
+		}
+
+		log = log.With(slog.String("client_id", client.ClientID))
+		state := r.Form.Get("state")
+
+		if responseType := r.Form.Get("response_type"); responseType != responseTypeCode {
+			log.Info("unsupported response type", slog.String("response_type", responseType))
+
+			redirectWithError(w, r, redirectURI, state, oauthUnsupportedResponse, "")
+			return
+		}
+
+		code, err := h.authService.Authorize(r.Context(), services.AuthAuthorizeInput{
+			GUID:                subject,
+			Client:              client,
+			RedirectURI:         redirectURI,
+			RedirectURIProvided: r.Form.Get("redirect_uri") != "",
+			Scopes:              strings.Fields(r.Form.Get("scope")),
+			CodeChallenge:       r.Form.Get("code_challenge"),
+			CodeChallengeMethod: r.Form.Get("code_challenge_method"),
+			Nonce:               r.Form.Get("nonce"),
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrInvalidCodeChallenge):
+				log.Info("invalid code challenge")
+
+				redirectWithError(w, r, redirectURI, state, oauthInvalidRequest, "code_challenge with S256 method is required")
+			case errors.Is(err, services.ErrInvalidScope):
+				log.Info("client requested scope it isn't allowed to get")
+
+				redirectWithError(w, r, redirectURI, state, oauthInvalidScope, "")
+			case errors.Is(err, services.ErrUnauthorizedClient):
+				log.Info("client isn't allowed to use authorization code grant")
+
+				redirectWithError(w, r, redirectURI, state, oauthUnauthorizedClient, "")
+			case errors.Is(err, services.ErrWrongCred):
+				log.Info("user not found", slog.String("guid", subject))
+
+				redirectWithError(w, r, redirectURI, state, oauthAccessDenied, "")
+			case errors.Is(err, services.ErrUserDisabled), errors.Is(err, services.ErrUserLocked), errors.Is(err, services.ErrUserPending):
+				log.Info("user isn't active", slog.String("guid", subject))
+
+				redirectWithError(w, r, redirectURI, state, oauthAccessDenied, err.Error())
+			default:
+				log.Error("internal error on authService.Authorize", slog.String("err", err.Error()))
+
+				redirectWithError(w, r, redirectURI, state, oauthServerError, "")
+			}
+			return
+		}
+
+		log.Info("authorization code issued", slog.String("guid", subject))
+
+		redirectWithParams(w, r, redirectURI, url.Values{
+			"code":  {code},
+			"state": {state},
+		})
+	}
+}
+
+// Token handles OAuth 2.0 token requests with form-encoded body. Confidential client authenticates with HTTP Basic
+// or client_id and client_secret form parameters, public client sends only client_id.
+// Supported grants are authorization_code, refresh_token and client_credentials. Public client refreshes only
+// with access token the refresh token was issued with, in Bearer header or access_token form parameter
+// 200 - OK. response contains access token and, for refresh_token grant, new refresh token
+// 400 - invalid_request, invalid_grant, unsupported_grant_type or invalid_scope
+// 401 - invalid_client
+// 405 - method is not POST
+// 429 - too many failed refresh attempts, Retry-After header tells when to retry
+// 500 - server_error
+func (h *OAuthHandler) Token(log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "rest.v1.handler.oauth.Token"
+
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			sendOAuthError(log, w, oauthInvalidRequest, "request body must be form-encoded", http.StatusBadRequest)
+			return
+		}
+
+		client, ok := h.authenticateClient(log, w, r)
+		if !ok {
+			return
+		}
+
+		log = log.With(slog.String("client_id", client.ClientID))
+
+		var tokens *auth.Tokens
+		var err error
+
+		switch grantType := r.PostForm.Get("grant_type"); grantType {
+		case grantTypeAuthorizationCode:
+			code, verifier := r.PostForm.Get("code"), r.PostForm.Get("code_verifier")
+			if code == "" || verifier == "" {
+				sendOAuthError(log, w, oauthInvalidRequest, "code and code_verifier are required", http.StatusBadRequest)
+				return
+			}
+
+			tokens, err = h.authService.ExchangeCode(r.Context(), services.AuthExchangeCodeInput{
+				Client:       client,
+				Code:         code,
+				RedirectURI:  r.PostForm.Get("redirect_uri"),
+				CodeVerifier: verifier,
+				IP:           clientIP(r),
+				UserAgent:    r.UserAgent(),
+			})
+		case grantTypeRefreshToken:
+			refreshToken := r.PostForm.Get("refresh_token")
+			if refreshToken == "" {
+				sendOAuthError(log, w, oauthInvalidRequest, TokenNotSpecifiedMsg, http.StatusBadRequest)
+				return
+			}
+
+			// public client can't prove it holds refresh token, so it's accepted only with its access token
+			accessToken := middleware.BearerToken(r)
+			if accessToken == "" {
+				accessToken = r.PostForm.Get("access_token")
+			}
+
+			tokens, err = h.authService.Refresh(r.Context(), services.AuthRefreshInput{
+				AccessToken:  accessToken,
+				RefreshToken: refreshToken,
+				Client:       client,
+				IP:           clientIP(r),
+				UserAgent:    r.UserAgent(),
+			})
+		case grantTypeClientCredentials:
+			scopes := strings.Fields(r.PostForm.Get("scope"))
+
+			tokens, err = h.authService.ClientCredentials(r.Context(), client, scopes)
+		case "":
+			sendOAuthError(log, w, oauthInvalidRequest, "grant_type is not specified", http.StatusBadRequest)
+			return
+		default:
+			log.Info("unsupported grant type", slog.String("grant_type", grantType))
+
+			sendOAuthError(log, w, oauthUnsupportedGrantType, "", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrTooManyAttempts):
+				log.Info("too many failed attempts")
+
+				setRetryAfter(w, err)
+				sendOAuthError(log, w, oauthInvalidGrant, TooManyAttemptsMsg, http.StatusTooManyRequests)
+			case errors.Is(err, services.ErrTokenReused):
+				log.Warn("refresh token reuse detected, session family revoked")
+
+				sendOAuthError(log, w, oauthInvalidGrant, "refresh token was already used", http.StatusBadRequest)
+			case errors.Is(err, services.ErrWrongCred):
+				log.Info("invalid grant")
+
+				sendOAuthError(log, w, oauthInvalidGrant, "", http.StatusBadRequest)
+			case errors.Is(err, services.ErrUserDisabled), errors.Is(err, services.ErrUserLocked), errors.Is(err, services.ErrUserPending):
+				log.Info("user isn't active")
+
+				sendOAuthError(log, w, oauthInvalidGrant, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, services.ErrInvalidScope):
+				log.Info("client requested scope it isn't allowed to get")
+
+				sendOAuthError(log, w, oauthInvalidScope, "", http.StatusBadRequest)
+			case errors.Is(err, services.ErrUnauthorizedClient):
+				log.Info("client isn't allowed to use grant type")
+
+				sendOAuthError(log, w, oauthUnauthorizedClient, "", http.StatusBadRequest)
+			case errors.Is(err, hasher.ErrBusy):
+				sendOAuthBusyError(log, w)
+			default:
+				log.Error("internal error on token issuing", slog.String("err", err.Error()))
+
+				sendOAuthError(log, w, oauthServerError, "", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		res := oauthTokenOutput{
+			AccessToken:  tokens.AccessToken,
+			TokenType:    tokenTypeBearer,
+			ExpiresIn:    int64(time.Until(tokens.AccessTokenExpiresIn).Round(time.Second).Seconds()),
+			RefreshToken: tokens.RefreshToken,
+			Scope:        strings.Join(tokens.Scopes, " "),
+			IDToken:      tokens.IDToken,
+		}
+
+		jsonRes, err := json.Marshal(res)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonRes)
+	}
+}
+
+// Introspect handles token introspection requests of confidential clients, RFC 7662.
+// token is access or refresh token, token_type_hint is optional
+// 200 - OK. response contains active flag and, for active token, its claims
+// 400 - invalid_request, token is not specified
+// 401 - invalid_client
+// 405 - method is not POST
+// 500 - server_error
+func (h *OAuthHandler) Introspect(log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "rest.v1.handler.oauth.Introspect"
+
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			sendOAuthError(log, w, oauthInvalidRequest, "request body must be form-encoded", http.StatusBadRequest)
+			return
+		}
+
+		client, ok := h.authenticateClient(log, w, r)
+		if !ok {
+			return
+		}
+
+		// public clients can't keep credentials, so anyone could introspect tokens on their behalf
+		if client.IsPublic() {
+			log.Info("public client can't introspect tokens", slog.String("client_id", client.ClientID))
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+			sendOAuthError(log, w, oauthInvalidClient, "client authentication is required", http.StatusUnauthorized)
+			return
+		}
+
+		token := r.PostForm.Get("token")
+		if token == "" {
+			sendOAuthError(log, w, oauthInvalidRequest, "token is not specified", http.StatusBadRequest)
+			return
+		}
+
+		introspection, err := h.authService.Introspect(r.Context(), token, r.PostForm.Get("token_type_hint"))
+		if err != nil {
+			if errors.Is(err, hasher.ErrBusy) {
+				sendOAuthBusyError(log, w)
+				return
+			}
+
+			log.Error("internal error on authService.Introspect", slog.String("err", err.Error()))
+
+			sendOAuthError(log, w, oauthServerError, "", http.StatusInternalServerError)
+			return
+		}
+
+		res := introspectionOutput{Active: introspection.Active}
+		if introspection.Active {
+			res.TokenType = introspection.TokenType
+			res.Subject = introspection.Subject
+			res.ClientID = introspection.ClientID
+			res.SessionID = introspection.SessionID
+			res.Scope = introspection.Scope
+			res.IssuedAt = introspection.IssuedAt.Unix()
+			res.ExpiresAt = introspection.ExpiresAt.Unix()
+		}
+
+		jsonRes, err := json.Marshal(res)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonRes)
+	}
+}
+
+// Revoke handles token revocation requests, RFC 7009. token is access or refresh token, token_type_hint is optional.
+// Revoked access token is denylisted until it expires, revoked refresh token ends its session
+// 200 - OK. token is revoked or it's unknown, invalid or expired
+// 400 - invalid_request, token is not specified, or unauthorized_client, token is issued to another client
+// 401 - invalid_client
+// 405 - method is not POST
+// 500 - server_error
+func (h *OAuthHandler) Revoke(log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "rest.v1.handler.oauth.Revoke"
+
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			sendOAuthError(log, w, oauthInvalidRequest, "request body must be form-encoded", http.StatusBadRequest)
+			return
+		}
+
+		client, ok := h.authenticateClient(log, w, r)
+		if !ok {
+			return
+		}
+
+		log = log.With(slog.String("client_id", client.ClientID))
+
+		token := r.PostForm.Get("token")
+		if token == "" {
+			sendOAuthError(log, w, oauthInvalidRequest, "token is not specified", http.StatusBadRequest)
+			return
+		}
+
+		err := h.authService.Revoke(r.Context(), client, token, r.PostForm.Get("token_type_hint"))
+		if err != nil {
+			if errors.Is(err, services.ErrUnauthorizedClient) {
+				log.Info("client tried to revoke token issued to another client")
+
+				sendOAuthError(log, w, oauthUnauthorizedClient, "token was issued to another client", http.StatusBadRequest)
+				return
+			}
+
+			if errors.Is(err, hasher.ErrBusy) {
+				sendOAuthBusyError(log, w)
+				return
+			}
+
+			log.Error("internal error on authService.Revoke", slog.String("err", err.Error()))
+
+			sendOAuthError(log, w, oauthServerError, "", http.StatusInternalServerError)
+			return
+		}
+
+		log.Info("token revoked")
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// authenticateClient authenticates client of token endpoint request and sends invalid_client error on failure
+func (h *OAuthHandler) authenticateClient(log *slog.Logger, w http.ResponseWriter, r *http.Request) (*model.Client, bool) {
+	clientID, secret, ok := clientCredentials(r)
+	if !ok {
+		log.Info("client credentials weren't specified")
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		sendOAuthError(log, w, oauthInvalidClient, "client authentication is required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	client, err := h.clientService.Authenticate(r.Context(), clientID, secret)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidClient) {
+			log.Info("client authentication failed", slog.String("client_id", clientID))
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+			sendOAuthError(log, w, oauthInvalidClient, "client authentication failed", http.StatusUnauthorized)
+			return nil, false
+		}
+
+		if errors.Is(err, hasher.ErrBusy) {
+			sendOAuthBusyError(log, w)
+			return nil, false
+		}
+
+		log.Error("internal error on clientService.Authenticate", slog.String("err", err.Error()))
+
+		sendOAuthError(log, w, oauthServerError, "", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return client, true
+}
+
+// clientCredentials returns credentials from HTTP Basic header or, if there is no header, from form parameters.
+// Secret is empty for public clients
+func clientCredentials(r *http.Request) (clientID string, secret string, ok bool) {
+	clientID, secret, ok = r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	return clientID, secret, clientID != ""
+}
+
+// redirectWithError redirects user agent back to client with error, RFC 6749 section 4.1.2.1
+func redirectWithError(w http.ResponseWriter, r *http.Request, redirectURI string, state string, code string, description string) {
+	params := url.Values{"error": {code}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	params.Set("state", state)
+
+	redirectWithParams(w, r, redirectURI, params)
+}
+
+// redirectWithParams adds params to query of redirectURI and redirects to it. Empty params are skipped
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	query := target.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// sendOAuthBusyError sends temporarily_unavailable error if all hashing workers are busy
+func sendOAuthBusyError(log *slog.Logger, w http.ResponseWriter) {
+	log.Warn("hasher is busy, request rejected")
+
+	w.Header().Set("Retry-After", busyRetryAfter)
+	sendOAuthError(log, w, oauthTemporarilyUnavail, "", http.StatusServiceUnavailable)
+}
+
+// sendOAuthError sends error response in RFC 6749 format
+func sendOAuthError(log *slog.Logger, w http.ResponseWriter, code string, description string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	res := oauthErrorOutput{
+		Error:            code,
+		ErrorDescription: description,
+	}
+	jsonRes, err := json.Marshal(res)
+	if err != nil {
+		log.Error("internal error on marshalling response", slog.String("err", err.Error()))
+		return
+	}
+	w.Write(jsonRes)
+}
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"github.com/4aykovksi/medods_test_task/internal/rest/v1/middleware"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+)
+
+const (
+	DiscoveryPath     = "/.well-known/openid-configuration"
+	JWKSPath          = "/.well-known/jwks.json"
+	AuthorizeCodePath = "/api/v1/oauth/authorize"
+	TokenPath         = "/oauth/token"
+	IntrospectPath    = "/oauth/introspect"
+	RevokePath        = "/oauth/revoke"
+	UserInfoPath      = "/userinfo"
+	discoveryCacheTTL = "public, max-age=3600"
+)
+
+type providerMetadata interface {
+	Issuer() string
+	SigningAlgorithms() []string
+}
+
+type userService interface {
+	GetUser(ctx context.Context, GUID string) (*model.User, error)
+}
+
+type OIDCHandler struct {
+	provider    providerMetadata
+	userService userService
+}
+
+func NewOIDCHandler(
+	provider providerMetadata,
+	userService userService,
+) *OIDCHandler {
+	return &OIDCHandler{
+		provider:    provider,
+		userService: userService,
+	}
+}
+
+// discoveryOutput is OpenID Provider Metadata, OpenID Connect Discovery 1.0 section 3.
+// authorization_endpoint isn't published: codes are issued by first-party API call at AuthorizeCodePath,
+// which isn't browser-facing authorization endpoint
+type discoveryOutput struct {
+	Issuer                            string   `json:"issuer"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type userInfoOutput struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+}
+
+// Discovery handles requests for OpenID Provider configuration. Endpoint URLs are built from issuer
+// 200 - OK. response contains provider metadata
+// 405 - method is not GET
+// 500 - various internal server errors
+func (h *OIDCHandler) Discovery(log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "rest.v1.handler.oidc.Discovery"
+
+		log := log.With(slog.String("op", op))
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		issuer := h.provider.Issuer()
+		res := discoveryOutput{
+			Issuer:                            issuer,
+			TokenEndpoint:                     issuer + TokenPath,
+			UserInfoEndpoint:                  issuer + UserInfoPath,
+			IntrospectionEndpoint:             issuer + IntrospectPath,
+			RevocationEndpoint:                issuer + RevokePath,
+			JWKSURI:                           issuer + JWKSPath,
+			ScopesSupported:                   []string{auth.ScopeOpenID, auth.ScopeEmail, auth.ScopeRoles},
+			ResponseTypesSupported:            []string{responseTypeCode},
+			GrantTypesSupported:               []string{grantTypeAuthorizationCode, grantTypeRefreshToken, grantTypeClientCredentials},
+			SubjectTypesSupported:             []string{"public"},
+			IDTokenSigningAlgValuesSupported:  h.provider.SigningAlgorithms(),
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:     []string{auth.CodeChallengeMethodS256},
+			ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "email", "roles"},
+		}
+
+		jsonRes, err := json.Marshal(res)
+		if err != nil {
+			log.Error("internal error on marshalling provider metadata", slog.String("err", err.Error()))
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", discoveryCacheTTL)
+		w.Write(jsonRes)
+	}
+}
+
+// UserInfo handles OpenID Connect userinfo requests. It's protected by openid scope, email is returned only with email scope
+// and roles only with roles scope
+// 200 - OK. response contains claims of the user access token was issued to
+// 401 - user of access token doesn't exist anymore
+// 405 - method is not GET or POST
+// 500 - various internal server errors
+func (h *OIDCHandler) UserInfo(log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "rest.v1.handler.oidc.UserInfo"
+
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, ok := middleware.ClaimsFromContext(r.Context())
+		if !ok {
+			log.Error("request isn't authenticated")
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		user, err := h.userService.GetUser(r.Context(), claims.Subject)
+		if err != nil {
+			if errors.Is(err, repository.ErrUserNotFound) {
+				log.Info("user not found", slog.String("guid", claims.Subject))
+
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				sendErrorResponse(log, w, middleware.InvalidAccessTokenMsg, http.StatusUnauthorized)
+				return
+			}
+
+			log.Error("internal error on userService.GetUser", slog.String("err", err.Error()))
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		res := userInfoOutput{
+			Subject: user.GUID,
+		}
+		if claims.HasScope(auth.ScopeEmail) {
+			res.Email = user.Email
+		}
+		if claims.HasScope(auth.ScopeRoles) {
+			res.Roles = user.Roles
+		}
+
+		jsonRes, err := json.Marshal(res)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonRes)
+	}
+}
@@ -0,0 +1,261 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"github.com/4aykovksi/medods_test_task/internal/rest/v1/middleware"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/api/response"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+)
+
+const (
+	SessionNotFoundMsg   = "session not found"
+	InvalidPaginationMsg = "limit must be positive integer and offset must be non-negative integer"
+	SessionsPath         = "/api/v1/sessions"
+	AdminSessionsPath    = "/api/v1/admin/sessions"
+	defaultSessionsLimit = 20
+	maxSessionsLimit     = 100
+)
+
+type sessionService interface {
+	ListUserSessions(ctx context.Context, GUID string, offset int64, limit int64) ([]model.RefreshSession, int64, error)
+	DeleteUserSession(ctx context.Context, GUID string, familyID string) error
+	DeleteSessionFamily(ctx context.Context, familyID string) error
+}
+
+// SessionHandler serves routes protected by middleware.Authenticate
+type SessionHandler struct {
+	sessionService sessionService
+}
+
+func NewSessionHandler(
+	sessionService sessionService,
+) *SessionHandler {
+	return &SessionHandler{
+		sessionService: sessionService,
+	}
+}
+
+// sessionOutput describes session family. ID is family id, it doesn't change when session is refreshed
+type sessionOutput struct {
+	ID          string    `json:"id"`
+	IP          string    `json:"ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	DeviceLabel string    `json:"device_label,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"`
+}
+
+type sessionsListOutput struct {
+	response.Response
+	Sessions []sessionOutput `json:"sessions"`
+	Total    int64           `json:"total"`
+	Limit    int64           `json:"limit"`
+	Offset   int64           `json:"offset"`
+}
+
+// List handles request for active sessions of the user the access token belongs to. It's protected by sessions scope
+// 200 - OK. response contains page of sessions, most recently used first
+// 400 - limit or offset is invalid
+// 405 - method is not GET
+// 500 - various internal server errors
+func (h *SessionHandler) List(log *slog.Logger) http.HandlerFunc {
+	return h.list(log, "rest.v1.handler.sessions.List", func(r *http.Request, claims *auth.Claims) string {
+		return claims.Subject
+	})
+}
+
+// AdminList handles request for active sessions of user with guid from query. It's protected by sessions:admin scope
+// Responses are the same as List ones, 400 is also returned if guid is not specified
+func (h *SessionHandler) AdminList(log *slog.Logger) http.HandlerFunc {
+	return h.list(log, "rest.v1.handler.sessions.AdminList", func(r *http.Request, _ *auth.Claims) string {
+		return r.URL.Query().Get("guid")
+	})
+}
+
+func (h *SessionHandler) list(log *slog.Logger, op string, userGUID func(r *http.Request, claims *auth.Claims) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, ok := middleware.ClaimsFromContext(r.Context())
+		if !ok {
+			log.Error("request isn't authenticated")
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		guid := userGUID(r, claims)
+		if guid == "" {
+			log.Info("guid wasn't specified")
+
+			sendErrorResponse(log, w, GuidNotSpecifiedMsg, http.StatusBadRequest)
+			return
+		}
+
+		limit, offset, ok := paginationParams(r, defaultSessionsLimit, maxSessionsLimit)
+		if !ok {
+			log.Info("invalid pagination parameters")
+
+			sendErrorResponse(log, w, InvalidPaginationMsg, http.StatusBadRequest)
+			return
+		}
+
+		sessions, total, err := h.sessionService.ListUserSessions(r.Context(), guid, offset, limit)
+		if err != nil {
+			log.Error("internal error on sessionService.ListUserSessions", slog.String("err", err.Error()))
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		res := sessionsListOutput{
+			Response: response.OK(),
+			Sessions: make([]sessionOutput, 0, len(sessions)),
+			Total:    total,
+			Limit:    limit,
+			Offset:   offset,
+		}
+		for _, session := range sessions {
+			res.Sessions = append(res.Sessions, sessionOutput{
+				ID:          session.Family(),
+				IP:          session.IP,
+				UserAgent:   session.UserAgent,
+				DeviceLabel: session.DeviceLabel,
+				CreatedAt:   session.CreatedAt.Time(),
+				LastUsedAt:  session.LastUsedAt.Time(),
+				ExpiresAt:   session.ExpiresIn.Time(),
+				Current:     session.Family() == claims.SessionID,
+			})
+		}
+
+		jsonRes, err := json.Marshal(res)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonRes)
+	}
+}
+
+// Delete handles request to revoke session by id from the list: DELETE /api/v1/sessions/{id}.
+// It's protected by sessions scope
+// 200 - OK. session is revoked
+// 404 - user doesn't have session with given id
+// 405 - method is not DELETE
+// 500 - various internal server errors
+func (h *SessionHandler) Delete(log *slog.Logger) http.HandlerFunc {
+	return h.delete(log, "rest.v1.handler.sessions.Delete", SessionsPath, func(ctx context.Context, claims *auth.Claims, id string) error {
+		return h.sessionService.DeleteUserSession(ctx, claims.Subject, id)
+	})
+}
+
+// AdminDelete handles request to revoke session of any user: DELETE /api/v1/admin/sessions/{id}.
+// It's protected by sessions:admin scope. Responses are the same as Delete ones
+func (h *SessionHandler) AdminDelete(log *slog.Logger) http.HandlerFunc {
+	return h.delete(log, "rest.v1.handler.sessions.AdminDelete", AdminSessionsPath, func(ctx context.Context, _ *auth.Claims, id string) error {
+		return h.sessionService.DeleteSessionFamily(ctx, id)
+	})
+}
+
+func (h *SessionHandler) delete(
+	log *slog.Logger,
+	op string,
+	basePath string,
+	deleteSession func(ctx context.Context, claims *auth.Claims, id string) error,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, ok := middleware.ClaimsFromContext(r.Context())
+		if !ok {
+			log.Error("request isn't authenticated")
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, basePath+"/")
+		if id == "" || strings.Contains(id, "/") {
+			sendErrorResponse(log, w, SessionNotFoundMsg, http.StatusNotFound)
+			return
+		}
+
+		err := deleteSession(r.Context(), claims, id)
+		if err != nil {
+			if errors.Is(err, repository.ErrSessionNotFound) {
+				log.Info("session not found", slog.String("id", id))
+
+				sendErrorResponse(log, w, SessionNotFoundMsg, http.StatusNotFound)
+				return
+			}
+
+			log.Error("internal error on session deletion", slog.String("err", err.Error()))
+
+			sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		log.Info("session revoked", slog.String("id", id))
+
+		jsonRes, err := json.Marshal(response.OK())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonRes)
+	}
+}
+
+// paginationParams reads limit and offset query parameters. Limit is capped with maxLimit.
+// Zero limit is rejected, because mongo treats it as no limit
+func paginationParams(r *http.Request, defaultLimit int64, maxLimit int64) (limit int64, offset int64, ok bool) {
+	limit, offset = defaultLimit, 0
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			return 0, 0, false
+		}
+		limit = min(parsed, maxLimit)
+	}
+
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return 0, 0, false
+		}
+		offset = parsed
+	}
+
+	return limit, offset, true
+}
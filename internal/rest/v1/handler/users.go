@@ -0,0 +1,399 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"github.com/4aykovksi/medods_test_task/internal/services"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/api/response"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/hasher"
+)
+
+const (
+	UserNotFoundMsg      = "user not found"
+	UserAlreadyExistsMsg = "user with this login already exists"
+	InvalidUserMsg       = "invalid user"
+	InvalidCursorMsg     = "cursor is invalid"
+	InvalidLimitMsg      = "limit must be positive integer"
+	PasswordTooShortMsg  = "password is too short"
+	LoginWithoutPassMsg  = "login and password must be set together"
+	InvalidUserStatusMsg = "invalid user status"
+	UsersPath            = "/api/v1/users"
+	defaultUsersLimit    = 20
+	maxUsersLimit        = 100
+)
+
+type userManagementService interface {
+	GetUser(ctx context.Context, GUID string) (*model.User, error)
+	CreateUser(ctx context.Context, input services.CreateUserInput) (*model.User, error)
+	ListUsers(ctx context.Context, filter repository.UserFilter, cursor string, limit int64) ([]model.User, string, error)
+	UpdateUser(ctx context.Context, GUID string, input services.UpdateUserInput) (*model.User, error)
+	SetUserStatus(ctx context.Context, GUID string, status string) (*model.User, error)
+	DeleteUser(ctx context.Context, GUID string) error
+}
+
+// UserHandler serves user management routes. They are protected by users:admin scope
+type UserHandler struct {
+	userService userManagementService
+}
+
+func NewUserHandler(
+	userService userManagementService,
+) *UserHandler {
+	return &UserHandler{
+		userService: userService,
+	}
+}
+
+type userOutput struct {
+	GUID        string    `json:"guid"`
+	Login       string    `json:"login,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Roles       []string  `json:"roles"`
+	Permissions []string  `json:"permissions"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type userResponse struct {
+	response.Response
+	User userOutput `json:"user"`
+}
+
+type usersListOutput struct {
+	response.Response
+	Users      []userOutput `json:"users"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type userCreateInput struct {
+	Login       string   `json:"login"`
+	Password    string   `json:"password"`
+	Email       string   `json:"email"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	Status      string   `json:"status"`
+}
+
+type userUpdateInput struct {
+	Login       *string   `json:"login"`
+	Password    *string   `json:"password"`
+	Email       *string   `json:"email"`
+	Roles       *[]string `json:"roles"`
+	Permissions *[]string `json:"permissions"`
+}
+
+// Users handles requests to users collection: /api/v1/users
+// GET lists users, optionally filtered by status, role and email query parameters. Page size is set with limit,
+// next page is requested with cursor returned as next_cursor
+// POST creates user with generated guid from JSON body {login, password, email, roles, permissions, status}.
+// User is active unless other status is given
+// 200 - OK. response contains page of users or created user
+// 400 - invalid body, status, cursor or limit, too short password
+// 405 - method is not GET or POST
+// 409 - user with the same login already exists
+// 500 - various internal server errors
+func (h *UserHandler) Users(log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "rest.v1.handler.users.Users"
+
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			h.list(log, w, r)
+		case http.MethodPost:
+			h.create(log, w, r)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// User handles requests to single user: /api/v1/users/{guid}
+// GET returns user, PATCH updates fields present in JSON body, DELETE deletes user.
+// POST /api/v1/users/{guid}/disable, /api/v1/users/{guid}/lock and /api/v1/users/{guid}/enable change user's status.
+// Deleted user and user who isn't active anymore lose all refresh sessions
+// 200 - OK. response contains user, DELETE response is empty
+// 400 - invalid body or too short password
+// 404 - user not found
+// 405 - method isn't allowed for the path
+// 409 - user with the same login already exists
+// 500 - various internal server errors
+func (h *UserHandler) User(log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "rest.v1.handler.users.User"
+
+		log := log.With(slog.String("op", op))
+		log.Info("start processing request")
+
+		w.Header().Set("Content-Type", "application/json")
+
+		guid, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, UsersPath+"/"), "/")
+		if guid == "" || strings.Contains(action, "/") {
+			sendErrorResponse(log, w, UserNotFoundMsg, http.StatusNotFound)
+			return
+		}
+		log = log.With(slog.String("guid", guid))
+
+		var status string
+		switch action {
+		case "":
+			switch r.Method {
+			case http.MethodGet:
+				h.get(log, w, r, guid)
+			case http.MethodPatch:
+				h.update(log, w, r, guid)
+			case http.MethodDelete:
+				h.delete(log, w, r, guid)
+			default:
+				w.Header().Set("Allow", http.MethodGet+", "+http.MethodPatch+", "+http.MethodDelete)
+				sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			}
+			return
+		case "disable":
+			status = model.UserStatusDisabled
+		case "enable":
+			status = model.UserStatusActive
+		case "lock":
+			status = model.UserStatusLocked
+		default:
+			sendErrorResponse(log, w, UserNotFoundMsg, http.StatusNotFound)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			sendErrorResponse(log, w, MethodNotAllowedMsg, http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, err := h.userService.SetUserStatus(r.Context(), guid, status)
+		if err != nil {
+			sendUserError(log, w, err)
+			return
+		}
+
+		log.Info("user status changed", slog.String("status", status))
+
+		sendUser(log, w, user)
+	}
+}
+
+func (h *UserHandler) list(log *slog.Logger, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := int64(defaultUsersLimit)
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			log.Info("invalid limit")
+
+			sendErrorResponse(log, w, InvalidLimitMsg, http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxUsersLimit)
+	}
+
+	filter := repository.UserFilter{
+		Status: query.Get("status"),
+		Role:   query.Get("role"),
+		Email:  query.Get("email"),
+	}
+
+	users, next, err := h.userService.ListUsers(r.Context(), filter, query.Get("cursor"), limit)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidCursor) {
+			log.Info("invalid cursor")
+
+			sendErrorResponse(log, w, InvalidCursorMsg, http.StatusBadRequest)
+			return
+		}
+
+		log.Error("internal error on userService.ListUsers", slog.String("err", err.Error()))
+
+		sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+		return
+	}
+
+	res := usersListOutput{
+		Response:   response.OK(),
+		Users:      make([]userOutput, 0, len(users)),
+		NextCursor: next,
+	}
+	for i := range users {
+		res.Users = append(res.Users, newUserOutput(&users[i]))
+	}
+
+	jsonRes, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonRes)
+}
+
+func (h *UserHandler) create(log *slog.Logger, w http.ResponseWriter, r *http.Request) {
+	var input userCreateInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		log.Info("invalid request body", slog.String("err", err.Error()))
+
+		sendErrorResponse(log, w, InvalidUserMsg, http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userService.CreateUser(r.Context(), services.CreateUserInput{
+		Login:       input.Login,
+		Password:    input.Password,
+		Email:       input.Email,
+		Roles:       input.Roles,
+		Permissions: input.Permissions,
+		Status:      input.Status,
+	})
+	if err != nil {
+		sendUserError(log, w, err)
+		return
+	}
+
+	log.Info("user created", slog.String("guid", user.GUID))
+
+	sendUser(log, w, user)
+}
+
+func (h *UserHandler) get(log *slog.Logger, w http.ResponseWriter, r *http.Request, guid string) {
+	user, err := h.userService.GetUser(r.Context(), guid)
+	if err != nil {
+		sendUserError(log, w, err)
+		return
+	}
+
+	sendUser(log, w, user)
+}
+
+func (h *UserHandler) update(log *slog.Logger, w http.ResponseWriter, r *http.Request, guid string) {
+	var input userUpdateInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		log.Info("invalid request body", slog.String("err", err.Error()))
+
+		sendErrorResponse(log, w, InvalidUserMsg, http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userService.UpdateUser(r.Context(), guid, services.UpdateUserInput{
+		Login:       input.Login,
+		Password:    input.Password,
+		Email:       input.Email,
+		Roles:       input.Roles,
+		Permissions: input.Permissions,
+	})
+	if err != nil {
+		sendUserError(log, w, err)
+		return
+	}
+
+	log.Info("user updated")
+
+	sendUser(log, w, user)
+}
+
+func (h *UserHandler) delete(log *slog.Logger, w http.ResponseWriter, r *http.Request, guid string) {
+	err := h.userService.DeleteUser(r.Context(), guid)
+	if err != nil {
+		sendUserError(log, w, err)
+		return
+	}
+
+	log.Info("user deleted")
+
+	jsonRes, err := json.Marshal(response.OK())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonRes)
+}
+
+func newUserOutput(user *model.User) userOutput {
+	output := userOutput{
+		GUID:        user.GUID,
+		Login:       user.Login,
+		Email:       user.Email,
+		Roles:       user.Roles,
+		Permissions: user.Permissions,
+		Status:      user.Status,
+		CreatedAt:   user.CreatedAt.Time(),
+		UpdatedAt:   user.UpdatedAt.Time(),
+	}
+	if output.Status == "" {
+		output.Status = model.UserStatusActive
+	}
+	if output.Roles == nil {
+		output.Roles = []string{}
+	}
+	if output.Permissions == nil {
+		output.Permissions = []string{}
+	}
+
+	return output
+}
+
+func sendUser(log *slog.Logger, w http.ResponseWriter, user *model.User) {
+	jsonRes, err := json.Marshal(userResponse{
+		Response: response.OK(),
+		User:     newUserOutput(user),
+	})
+	if err != nil {
+		log.Error("internal error on marshalling response", slog.String("err", err.Error()))
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonRes)
+}
+
+// sendUserError maps user service error to response
+func sendUserError(log *slog.Logger, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repository.ErrUserNotFound):
+		log.Info("user not found")
+
+		sendErrorResponse(log, w, UserNotFoundMsg, http.StatusNotFound)
+	case errors.Is(err, repository.ErrUserAlreadyExists):
+		log.Info("user already exists")
+
+		sendErrorResponse(log, w, UserAlreadyExistsMsg, http.StatusConflict)
+	case errors.Is(err, services.ErrPasswordTooShort):
+		log.Info("password is too short")
+
+		sendErrorResponse(log, w, PasswordTooShortMsg, http.StatusBadRequest)
+	case errors.Is(err, services.ErrLoginWithoutPassword):
+		log.Info("login without password")
+
+		sendErrorResponse(log, w, LoginWithoutPassMsg, http.StatusBadRequest)
+	case errors.Is(err, services.ErrInvalidUserStatus):
+		log.Info("invalid user status")
+
+		sendErrorResponse(log, w, InvalidUserStatusMsg, http.StatusBadRequest)
+	case errors.Is(err, hasher.ErrBusy):
+		sendBusyError(log, w, err)
+	default:
+		log.Error("internal error on userService", slog.String("err", err.Error()))
+
+		sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+	}
+}
@@ -1 +1,181 @@
 package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/4aykovksi/medods_test_task/pkg/lib/api/response"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+)
+
+const (
+	InvalidAccessTokenMsg  = "access token is missing or invalid"
+	InsufficientScopeMsg   = "access token doesn't grant access to the resource"
+	InternalServerErrorMsg = "internal server error"
+)
+
+type ctxKey int
+
+const claimsKey ctxKey = iota
+
+type tokenParser interface {
+	Parse(inputToken string) (*auth.Claims, error)
+}
+
+type tokenDenylist interface {
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+type tokenVersionChecker interface {
+	IsTokenVersionCurrent(ctx context.Context, GUID string, version int64) (bool, error)
+}
+
+// Authenticate validates bearer access token: signature, expiration, issuer and audience,
+// and checks that token isn't revoked and, for user's token, that user's token version wasn't increased.
+// Claims of valid token are put into request context, requests with invalid, revoked or stale token get 401
+func Authenticate(log *slog.Logger, parser tokenParser, denylist tokenDenylist, versions tokenVersionChecker) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			const op = "rest.v1.middleware.Authenticate"
+
+			log := log.With(slog.String("op", op))
+
+			token := BearerToken(r)
+			if token == "" {
+				log.Info("access token is not specified")
+
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				sendErrorResponse(log, w, InvalidAccessTokenMsg, http.StatusUnauthorized)
+				return
+			}
+
+			claims, err := parser.Parse(token)
+			if err != nil {
+				log.Info("invalid access token", slog.String("err", err.Error()))
+
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				sendErrorResponse(log, w, InvalidAccessTokenMsg, http.StatusUnauthorized)
+				return
+			}
+
+			revoked, err := denylist.IsRevoked(r.Context(), claims.Id)
+			if err != nil {
+				log.Error("internal error on denylist.IsRevoked", slog.String("err", err.Error()))
+
+				sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+				return
+			}
+			if revoked {
+				log.Info("access token is revoked", slog.String("sub", claims.Subject))
+
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				sendErrorResponse(log, w, InvalidAccessTokenMsg, http.StatusUnauthorized)
+				return
+			}
+
+			// client credentials tokens don't belong to user, only user's tokens have session id
+			if claims.SessionID != "" {
+				current, err := versions.IsTokenVersionCurrent(r.Context(), claims.Subject, claims.TokenVersion)
+				if err != nil {
+					log.Error("internal error on versions.IsTokenVersionCurrent", slog.String("err", err.Error()))
+
+					sendErrorResponse(log, w, InternalServerErrorMsg, http.StatusInternalServerError)
+					return
+				}
+				if !current {
+					log.Info("access token is stale", slog.String("sub", claims.Subject))
+
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					sendErrorResponse(log, w, InvalidAccessTokenMsg, http.StatusUnauthorized)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		})
+	}
+}
+
+// RequireScope allows request only if access token has scope. Must be used after Authenticate
+func RequireScope(log *slog.Logger, scope string) func(next http.Handler) http.Handler {
+	return require(log, "rest.v1.middleware.RequireScope", func(claims *auth.Claims) bool {
+		return claims.HasScope(scope)
+	}, fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+}
+
+func require(log *slog.Logger, op string, allowed func(claims *auth.Claims) bool, challenge string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := log.With(slog.String("op", op))
+
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok {
+				log.Info("request isn't authenticated")
+
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				sendErrorResponse(log, w, InvalidAccessTokenMsg, http.StatusUnauthorized)
+				return
+			}
+
+			if !allowed(claims) {
+				log.Info("access denied", slog.String("sub", claims.Subject))
+
+				w.Header().Set("WWW-Authenticate", challenge)
+				sendErrorResponse(log, w, InsufficientScopeMsg, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithClaims returns copy of ctx carrying access token claims
+func WithClaims(ctx context.Context, claims *auth.Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext returns claims of access token put by Authenticate
+func ClaimsFromContext(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*auth.Claims)
+	return claims, ok
+}
+
+// SubjectFromContext returns GUID of the user access token was issued to
+func SubjectFromContext(ctx context.Context) (string, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	return claims.Subject, true
+}
+
+// BearerToken returns token from Authorization header or empty string if there is no bearer token
+func BearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// sendErrorResponse send response with given statusCode as http status code and msg in body
+func sendErrorResponse(log *slog.Logger, w http.ResponseWriter, msg string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	res := response.Error(msg)
+	jsonRes, err := json.Marshal(res)
+	if err != nil {
+		log.Error("internal error on marshalling response", slog.String("err", err.Error()))
+		return
+	}
+	w.Write(jsonRes)
+}
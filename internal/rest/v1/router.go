@@ -5,28 +5,104 @@ import (
 	"log/slog"
 	"net/http"
 
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
 	"github.com/4aykovksi/medods_test_task/internal/rest/v1/handler"
+	"github.com/4aykovksi/medods_test_task/internal/rest/v1/middleware"
 	"github.com/4aykovksi/medods_test_task/internal/services"
 	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
 )
 
 type authService interface {
 	SignIn(ctx context.Context, input services.AuthSignInInput) (*auth.Tokens, error)
-	Refresh(ctx context.Context, base64token string) (*auth.Tokens, error)
+	Refresh(ctx context.Context, input services.AuthRefreshInput) (*auth.Tokens, error)
+	Logout(ctx context.Context, base64token string) error
+	LogoutAll(ctx context.Context, base64token string) error
+	LogoutOthers(ctx context.Context, base64token string) error
+	ClientCredentials(ctx context.Context, client *model.Client, scopes []string) (*auth.Tokens, error)
+	Authorize(ctx context.Context, input services.AuthAuthorizeInput) (string, error)
+	ExchangeCode(ctx context.Context, input services.AuthExchangeCodeInput) (*auth.Tokens, error)
+	Introspect(ctx context.Context, token string, hint string) (*services.Introspection, error)
+	Revoke(ctx context.Context, client *model.Client, token string, hint string) error
+}
+
+type clientService interface {
+	Authenticate(ctx context.Context, clientID string, secret string) (*model.Client, error)
+	FindClient(ctx context.Context, clientID string) (*model.Client, error)
+}
+
+type sessionService interface {
+	ListUserSessions(ctx context.Context, GUID string, offset int64, limit int64) ([]model.RefreshSession, int64, error)
+	DeleteUserSession(ctx context.Context, GUID string, familyID string) error
+	DeleteSessionFamily(ctx context.Context, familyID string) error
+}
+
+type userService interface {
+	GetUser(ctx context.Context, GUID string) (*model.User, error)
+	CreateUser(ctx context.Context, input services.CreateUserInput) (*model.User, error)
+	ListUsers(ctx context.Context, filter repository.UserFilter, cursor string, limit int64) ([]model.User, string, error)
+	UpdateUser(ctx context.Context, GUID string, input services.UpdateUserInput) (*model.User, error)
+	SetUserStatus(ctx context.Context, GUID string, status string) (*model.User, error)
+	DeleteUser(ctx context.Context, GUID string) error
+	IsTokenVersionCurrent(ctx context.Context, GUID string, version int64) (bool, error)
+}
+
+type tokenDenylist interface {
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+type tokenManager interface {
+	Parse(inputToken string) (*auth.Claims, error)
+	JWKS() auth.JWKS
+	Issuer() string
+	SigningAlgorithms() []string
 }
 
 func NewRouter(
 	log *slog.Logger,
 	authService authService,
+	sessionService sessionService,
+	clientService clientService,
+	userService userService,
+	tokenManager tokenManager,
+	tokenDenylist tokenDenylist,
 ) *http.ServeMux {
 
 	var (
-		mux         = http.NewServeMux()
-		authHandler = handler.NewAuthHandler(authService)
+		mux            = http.NewServeMux()
+		authHandler    = handler.NewAuthHandler(authService)
+		sessionHandler = handler.NewSessionHandler(sessionService)
+		userHandler    = handler.NewUserHandler(userService)
+		oauthHandler   = handler.NewOAuthHandler(authService, clientService)
+		oidcHandler    = handler.NewOIDCHandler(tokenManager, userService)
+		jwksHandler    = handler.NewJWKSHandler(tokenManager)
+		authenticate   = middleware.Authenticate(log, tokenManager, tokenDenylist, userService)
+		ownSessions    = middleware.RequireScope(log, model.ScopeSessions)
+		sessionsAdmin  = middleware.RequireScope(log, model.ScopeSessionsAdmin)
+		usersAdmin     = middleware.RequireScope(log, model.ScopeUsersAdmin)
+		openID         = middleware.RequireScope(log, auth.ScopeOpenID)
 	)
 
+	mux.HandleFunc(handler.JWKSPath, jwksHandler.JWKS(log))
+	mux.HandleFunc(handler.DiscoveryPath, oidcHandler.Discovery(log))
+
+	mux.Handle(handler.AuthorizeCodePath, authenticate(oauthHandler.Authorize(log)))
+	mux.HandleFunc(handler.TokenPath, oauthHandler.Token(log))
+	mux.HandleFunc(handler.IntrospectPath, oauthHandler.Introspect(log))
+	mux.HandleFunc(handler.RevokePath, oauthHandler.Revoke(log))
+	mux.Handle(handler.UserInfoPath, authenticate(openID(oidcHandler.UserInfo(log))))
+
 	mux.HandleFunc("/api/v1/auth/signIn", authHandler.SignIn(log))
 	mux.HandleFunc("/api/v1/auth/refresh", authHandler.Refresh(log))
+	mux.HandleFunc("/api/v1/auth/logout", authHandler.Logout(log))
+	mux.HandleFunc("/api/v1/auth/logout/all", authHandler.LogoutAll(log))
+	mux.HandleFunc("/api/v1/auth/logout/others", authHandler.LogoutOthers(log))
+	mux.Handle(handler.SessionsPath, authenticate(ownSessions(sessionHandler.List(log))))
+	mux.Handle(handler.SessionsPath+"/", authenticate(ownSessions(sessionHandler.Delete(log))))
+	mux.Handle(handler.AdminSessionsPath, authenticate(sessionsAdmin(sessionHandler.AdminList(log))))
+	mux.Handle(handler.AdminSessionsPath+"/", authenticate(sessionsAdmin(sessionHandler.AdminDelete(log))))
+	mux.Handle(handler.UsersPath, authenticate(usersAdmin(userHandler.Users(log))))
+	mux.Handle(handler.UsersPath+"/", authenticate(usersAdmin(userHandler.User(log))))
 
 	return mux
 }
@@ -2,82 +2,226 @@ package services
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/4aykovksi/medods_test_task/internal/model"
 	"github.com/4aykovksi/medods_test_task/internal/repository"
 	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/mail"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrPasswordRequired    = errors.New("user must sign in with login and password")
+	ErrAccessTokenRequired = errors.New("access token is required to refresh")
 )
 
 type userRepository interface {
 	FindByGUID(ctx context.Context, guid string) (*model.User, error)
+	FindByLogin(ctx context.Context, login string) (*model.User, error)
+	UpdatePasswordHash(ctx context.Context, GUID string, oldHash string, newHash string) error
 }
 
 type refreshSessionService interface {
-	CreateRefreshSession(ctx context.Context, GUID string, token string, ttl time.Duration) error
-	ValidateRefreshSession(ctx context.Context, GUID string, token string) error
+	CreateRefreshSession(ctx context.Context, input CreateRefreshSessionInput) error
+	ValidateRefreshSession(ctx context.Context, input ValidateRefreshSessionInput) (*model.RefreshSession, error)
+	FindActiveSession(ctx context.Context, GUID string, selector string, verifier string) (*model.RefreshSession, error)
+	DeleteSession(ctx context.Context, session *model.RefreshSession) error
+	DeleteAllUserSessions(ctx context.Context, GUID string) error
+	DeleteOtherUserSessions(ctx context.Context, session *model.RefreshSession) error
+	DeleteSessionFamily(ctx context.Context, familyID string) error
+	IsFamilyActive(ctx context.Context, familyID string) (bool, error)
+	SetSuccessor(ctx context.Context, session *model.RefreshSession, successor []byte) error
+	WaitSuccessor(ctx context.Context, session *model.RefreshSession) ([]byte, error)
 }
 
 type tokenManager interface {
-	CreateTokensPair(userId string, accessTokenTtl, refreshTokenTtl time.Duration) (*auth.Tokens, error)
-	Parse(inputToken string) (string, error)
+	CreateTokensPair(params auth.TokenParams) (*auth.Tokens, error)
+	CreateAccessToken(params auth.TokenParams) (*auth.Tokens, error)
+	CreateAuthorizationCode() (string, error)
+	Parse(inputToken string) (*auth.Claims, error)
+	ParseAllowExpired(inputToken string) (*auth.Claims, error)
+}
+
+type authorizationCodeRepository interface {
+	Insert(ctx context.Context, code model.AuthorizationCode) error
+	Redeem(ctx context.Context, codeHash string) (*model.AuthorizationCode, error)
+}
+
+type tokenDenylist interface {
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+type attemptThrottle interface {
+	Check(ctx context.Context, keys ...string) error
+	Failure(ctx context.Context, keys ...string) error
+	Success(ctx context.Context, keys ...string) error
 }
 
+// hasher may limit concurrent operations, then Hash and CompareHash fail with hasher.ErrBusy
+// or context error instead of waiting too long
 type hasher interface {
-	Hash(input string) (string, error)
-	CompareHash(hash string, input string) bool
+	Hash(ctx context.Context, input string) (string, error)
+	CompareHash(ctx context.Context, hash string, input string) (bool, error)
+	NeedsRehash(hash string) bool
+}
+
+type mailSender interface {
+	Send(ctx context.Context, msg mail.Message) error
 }
 
 type AuthService struct {
+	log *slog.Logger
+
 	userRepo              userRepository
+	clientRepo            clientRepository
+	authCodeRepo          authorizationCodeRepository
 	refreshSessionService refreshSessionService
+	tokenDenylist         tokenDenylist
+	throttle              attemptThrottle
 
 	tokenManager tokenManager
 	hasher       hasher
+	mailSender   mailSender
 
 	accessTokenTTL  time.Duration
 	refreshTokenTTL time.Duration
+	authCodeTTL     time.Duration
+
+	// defaultClientID is id of first-party client used by sign-in and refresh without client_id.
+	// If it's empty, client_id is required
+	defaultClientID string
+
+	// dummyHash is compared with password of unknown users, so they take as long as known ones
+	dummyHash   string
+	dummyHashMu sync.Mutex
 }
 
 func NewAuthService(
+	log *slog.Logger,
 	userRepo userRepository,
+	clientRepo clientRepository,
+	authCodeRepo authorizationCodeRepository,
 	sessionService refreshSessionService,
+	tokenDenylist tokenDenylist,
+	throttle attemptThrottle,
 	manager tokenManager,
 	hasher hasher,
+	mailSender mailSender,
 	accessTokenTTL time.Duration,
 	refreshTokenTTL time.Duration,
+	authCodeTTL time.Duration,
+	defaultClientID string,
 ) *AuthService {
 	return &AuthService{
+		log:                   log,
 		userRepo:              userRepo,
+		clientRepo:            clientRepo,
+		authCodeRepo:          authCodeRepo,
 		refreshSessionService: sessionService,
+		tokenDenylist:         tokenDenylist,
+		throttle:              throttle,
 		tokenManager:          manager,
 		hasher:                hasher,
+		mailSender:            mailSender,
 		accessTokenTTL:        accessTokenTTL,
 		refreshTokenTTL:       refreshTokenTTL,
+		authCodeTTL:           authCodeTTL,
+		defaultClientID:       defaultClientID,
 	}
 }
 
+// AuthSignInInput identifies user either by GUID or by Login and Password
 type AuthSignInInput struct {
-	GUID string
+	GUID     string
+	Login    string
+	Password string
+	// ClientID is id of first-party application user signs in with, default client is used if it's empty
+	ClientID    string
+	IP          string
+	UserAgent   string
+	DeviceLabel string
 }
 
+// SignIn issues tokens pair for user. If login is specified, user is authenticated with password and ErrWrongCred is
+// returned for unknown login or wrong password, otherwise user is found by GUID. User with password can't sign in by GUID,
+// ErrPasswordRequired is returned for such user.
+// ErrUserDisabled, ErrUserLocked or ErrUserPending is returned if user isn't active.
+// Client or default one must be registered and allowed to use sign_in grant, otherwise ErrInvalidClient or ErrUnauthorizedClient is returned.
+// Failed attempts are counted per user and IP, *TooManyAttemptsError is returned while any of them is locked
 func (service *AuthService) SignIn(ctx context.Context, input AuthSignInInput) (*auth.Tokens, error) {
-	const op = "internal.services.auth.SignIn"
+	var keys []string
+	keys = appendThrottleKey(keys, throttleKeyIP, input.IP)
+	if input.Login != "" {
+		keys = appendThrottleKey(keys, throttleKeyLogin, input.Login)
+	} else {
+		keys = appendThrottleKey(keys, throttleKeyUser, input.GUID)
+	}
+
+	return service.throttled(ctx, keys, func() (*auth.Tokens, error) {
+		return service.signIn(ctx, input)
+	})
+}
 
-	user, err := service.userRepo.FindByGUID(ctx, input.GUID)
+func (service *AuthService) signIn(ctx context.Context, input AuthSignInInput) (*auth.Tokens, error) {
+	const op = "internal.services.auth.signIn"
+
+	client, err := service.findClient(ctx, input.ClientID, model.GrantSignIn)
 	if err != nil {
-		if errors.Is(err, repository.ErrUserNotFound) {
-			return nil, repository.ErrUserNotFound
+		if errors.Is(err, ErrInvalidClient) || errors.Is(err, ErrUnauthorizedClient) {
+			return nil, err
 		}
 
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	tokens, err := service.getTokensPair(ctx, user.GUID)
+	var user *model.User
+	if input.Login != "" {
+		user, err = service.authenticate(ctx, input.Login, input.Password)
+		if err != nil {
+			if errors.Is(err, ErrWrongCred) {
+				return nil, ErrWrongCred
+			}
+
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	} else {
+		user, err = service.userRepo.FindByGUID(ctx, input.GUID)
+		if err != nil {
+			if errors.Is(err, repository.ErrUserNotFound) {
+				return nil, repository.ErrUserNotFound
+			}
+
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		// GUID isn't a secret, so it only signs in users without credentials.
+		// It isn't counted as failed attempt, otherwise anyone could lock the user out
+		if user.PasswordHash != "" {
+			return nil, ErrPasswordRequired
+		}
+	}
+
+	if err := checkUserStatus(user); err != nil {
+		return nil, err
+	}
+
+	tokens, err := service.getTokensPair(ctx, user, client, CreateRefreshSessionInput{
+		Grant:       model.GrantSignIn,
+		IP:          input.IP,
+		UserAgent:   input.UserAgent,
+		DeviceLabel: input.DeviceLabel,
+	}, "")
 	if err != nil {
 		if errors.Is(err, repository.ErrSessionAlreadyExists) {
 			return nil, repository.ErrSessionAlreadyExists
@@ -89,25 +233,240 @@ func (service *AuthService) SignIn(ctx context.Context, input AuthSignInInput) (
 	return tokens, nil
 }
 
-func (service *AuthService) Refresh(ctx context.Context, base64token string) (*auth.Tokens, error) {
-	const op = "internal.services.auth.Refresh"
+type AuthRefreshInput struct {
+	AccessToken  string
+	RefreshToken string
+	// Client is OAuth client from token endpoint. Confidential client authenticated with its secret refreshes
+	// without access token, public one only tells its id, so it presents access token as well
+	Client *model.Client
+	// ClientID is id of first-party application, default client is used if it's empty. It's ignored if Client is set
+	ClientID  string
+	IP        string
+	UserAgent string
+}
 
-	token, err := service.decodeBase64Token(base64token)
+// Refresh issues new tokens pair. Refresh token is accepted only together with access token it was issued with
+// or, for authenticated OAuth clients, only by the client it was issued to. Session of first-party application
+// can be refreshed only by the same application.
+// User is reloaded on every refresh, so user who isn't active anymore gets the same error as on sign in.
+// If refresh is requested from IP other than the session was created from, user gets warning email.
+// Within refresh grace period the same token presented with the same access token or by the same client gets
+// the same new pair, so concurrent refreshes from several tabs don't look like reuse. Later it's detected as reuse as before.
+// Failed attempts are counted per IP, token selector and user of access token, *TooManyAttemptsError is returned
+// while any of them is locked. User is taken only from access token with valid signature, GUID of legacy token
+// isn't trusted, otherwise forged tokens would lock user out.
+// Legacy "guid-hex" token is accepted only by first-party refresh without access token binding, it's exchanged for
+// token of the current format
+func (service *AuthService) Refresh(ctx context.Context, input AuthRefreshInput) (*auth.Tokens, error) {
+	var keys []string
+	keys = appendThrottleKey(keys, throttleKeyIP, input.IP)
+	_, selector, _, err := service.parseRefreshToken(input.RefreshToken)
+	if err == nil {
+		keys = appendThrottleKey(keys, throttleKeySelector, selector)
+	}
+	if claims, err := service.tokenManager.ParseAllowExpired(input.AccessToken); err == nil {
+		keys = appendThrottleKey(keys, throttleKeyUser, claims.Subject)
+	}
+
+	return service.throttled(ctx, keys, func() (*auth.Tokens, error) {
+		return service.refresh(ctx, input)
+	})
+}
+
+func (service *AuthService) refresh(ctx context.Context, input AuthRefreshInput) (*auth.Tokens, error) {
+	const op = "internal.services.auth.refresh"
+
+	tokenGUID, selector, verifier, err := service.parseRefreshToken(input.RefreshToken)
 	if err != nil {
 		return nil, ErrWrongCred
 	}
+	// legacy tokens were issued only by first-party sign-in
+	if tokenGUID != "" && input.Client != nil {
+		return nil, ErrWrongCred
+	}
+
+	client := input.Client
+	authenticated := client != nil && !client.IsPublic()
+	if client != nil {
+		if !client.AllowsGrant(model.GrantRefreshToken) {
+			return nil, ErrUnauthorizedClient
+		}
+	} else {
+		client, err = service.findClient(ctx, input.ClientID, model.GrantSignIn)
+		if err != nil {
+			if errors.Is(err, ErrInvalidClient) || errors.Is(err, ErrUnauthorizedClient) {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	validateInput := ValidateRefreshSessionInput{
+		GUID:                tokenGUID,
+		ClientID:            client.ClientID,
+		ClientAuthenticated: authenticated,
+		IP:                  input.IP,
+		Selector:            selector,
+		Verifier:            verifier,
+	}
+
+	// legacy tokens predate access token binding, their access tokens were signed with retired secret
+	if !authenticated && tokenGUID == "" {
+		if input.AccessToken == "" {
+			return nil, ErrAccessTokenRequired
+		}
+
+		claims, err := service.tokenManager.ParseAllowExpired(input.AccessToken)
+		if err != nil {
+			return nil, ErrWrongCred
+		}
+
+		// revoked access token can't be used to get new tokens pair
+		revoked, err := service.tokenDenylist.IsRevoked(ctx, claims.Id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if revoked {
+			return nil, ErrWrongCred
+		}
+
+		validateInput.GUID = claims.Subject
+		validateInput.AccessTokenID = claims.Id
+	}
+
+	return service.rotate(ctx, input, client, validateInput)
+}
+
+// rotate exchanges refresh token described by validateInput for new tokens pair. New pair is stored sealed
+// on rotated session, so concurrent requests within grace period get it instead of being treated as reuse
+func (service *AuthService) rotate(
+	ctx context.Context,
+	input AuthRefreshInput,
+	client *model.Client,
+	validateInput ValidateRefreshSessionInput,
+) (*auth.Tokens, error) {
+	const op = "internal.services.auth.rotate"
+
+	session, err := service.refreshSessionService.ValidateRefreshSession(ctx, validateInput)
+	if err != nil {
+		if errors.Is(err, errRotatedWithinGrace) {
+			return service.successorTokens(ctx, session, validateInput)
+		}
+		if errors.Is(err, ErrTokenReused) {
+			return nil, ErrTokenReused
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// user is reloaded, so new access token carries actual roles and permissions
+	user, err := service.userRepo.FindByGUID(ctx, session.GUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := checkUserStatus(user); err != nil {
+		return nil, err
+	}
 
-	GUID, err := service.getGUIDFromToken(token)
+	if session.IP != "" && session.IP != input.IP {
+		service.warnAboutNewIP(ctx, user, session.IP, input.IP)
+	}
+
+	tokens, err := service.getTokensPair(ctx, user, client, CreateRefreshSessionInput{
+		Grant:       session.Grant,
+		Scopes:      session.Scopes,
+		FamilyID:    session.FamilyID,
+		IP:          input.IP,
+		UserAgent:   input.UserAgent,
+		DeviceLabel: session.DeviceLabel,
+		CreatedAt:   session.CreatedAt.Time(),
+	}, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// failure only makes concurrent requests with the same token wait for grace period and fail with ErrWrongCred
+	successor, err := sealTokens(tokens, validateInput.Verifier, session.ID)
+	if err == nil {
+		err = service.refreshSessionService.SetSuccessor(ctx, session, successor)
+	}
 	if err != nil {
+		service.log.Error("can't store tokens pair of rotated session", slog.String("op", op), slog.String("err", err.Error()))
+	}
+
+	return tokens, nil
+}
+
+// successorTokens returns tokens pair session rotated within grace period was exchanged for.
+// User is checked again, so the pair isn't returned after user was blocked or signed out everywhere
+func (service *AuthService) successorTokens(
+	ctx context.Context,
+	session *model.RefreshSession,
+	validateInput ValidateRefreshSessionInput,
+) (*auth.Tokens, error) {
+	const op = "internal.services.auth.successorTokens"
+
+	successor, err := service.refreshSessionService.WaitSuccessor(ctx, session)
+	if err != nil {
+		if errors.Is(err, ErrWrongCred) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	user, err := service.userRepo.FindByGUID(ctx, session.GUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := checkUserStatus(user); err != nil {
+		return nil, err
+	}
+	if session.TokenVersion < user.TokenVersion {
 		return nil, ErrWrongCred
 	}
 
-	err = service.refreshSessionService.ValidateRefreshSession(ctx, GUID, string(token))
+	tokens, err := openTokens(successor, validateInput.Verifier, session.ID)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	tokens, err := service.getTokensPair(ctx, GUID)
+	return tokens, nil
+}
+
+// ClientCredentials issues access token to client itself. Refresh token isn't issued for this grant.
+// ErrInvalidScope is returned if client isn't allowed to get any of requested scopes
+func (service *AuthService) ClientCredentials(ctx context.Context, client *model.Client, scopes []string) (*auth.Tokens, error) {
+	const op = "internal.services.auth.ClientCredentials"
+
+	// public client can't keep credentials, so it can't act on its own behalf
+	if client.IsPublic() || !client.AllowsGrant(model.GrantClientCredentials) {
+		return nil, ErrUnauthorizedClient
+	}
+
+	granted, err := grantedScopes(client.Scopes, scopes)
+	if err != nil {
+		return nil, ErrInvalidScope
+	}
+
+	accessTokenTTL, _ := client.TokenTTLs(service.accessTokenTTL, service.refreshTokenTTL)
+
+	tokens, err := service.tokenManager.CreateAccessToken(auth.TokenParams{
+		Subject:        client.ClientID,
+		ClientID:       client.ClientID,
+		Scopes:         granted,
+		AccessTokenTTL: accessTokenTTL,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
@@ -115,20 +474,329 @@ func (service *AuthService) Refresh(ctx context.Context, base64token string) (*a
 	return tokens, nil
 }
 
-func (service *AuthService) getTokensPair(ctx context.Context, GUID string) (*auth.Tokens, error) {
+// Logout revokes session of refresh token
+func (service *AuthService) Logout(ctx context.Context, base64token string) error {
+	const op = "internal.services.auth.Logout"
+
+	session, err := service.findSessionByToken(ctx, base64token)
+	if err != nil {
+		if errors.Is(err, ErrWrongCred) {
+			return ErrWrongCred
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = service.refreshSessionService.DeleteSession(ctx, session)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// LogoutAll revokes every session of the user refresh token belongs to
+func (service *AuthService) LogoutAll(ctx context.Context, base64token string) error {
+	const op = "internal.services.auth.LogoutAll"
+
+	session, err := service.findSessionByToken(ctx, base64token)
+	if err != nil {
+		if errors.Is(err, ErrWrongCred) {
+			return ErrWrongCred
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = service.refreshSessionService.DeleteAllUserSessions(ctx, session.GUID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// LogoutOthers revokes every session of the user except session of refresh token
+func (service *AuthService) LogoutOthers(ctx context.Context, base64token string) error {
+	const op = "internal.services.auth.LogoutOthers"
+
+	session, err := service.findSessionByToken(ctx, base64token)
+	if err != nil {
+		if errors.Is(err, ErrWrongCred) {
+			return ErrWrongCred
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = service.refreshSessionService.DeleteOtherUserSessions(ctx, session)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (service *AuthService) findSessionByToken(ctx context.Context, base64token string) (*model.RefreshSession, error) {
+	const op = "internal.services.auth.findSessionByToken"
+
+	GUID, selector, verifier, err := service.parseRefreshToken(base64token)
+	if err != nil {
+		return nil, ErrWrongCred
+	}
+
+	session, err := service.refreshSessionService.FindActiveSession(ctx, GUID, selector, verifier)
+	if err != nil {
+		if errors.Is(err, ErrWrongCred) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return session, nil
+}
+
+// throttled makes attempt unless any of keys is locked. Wrong credentials and token reuse are counted as failures
+// of every key, successful attempt resets counters of every key except IP one
+func (service *AuthService) throttled(ctx context.Context, keys []string, attempt func() (*auth.Tokens, error)) (*auth.Tokens, error) {
+	const op = "internal.services.auth.throttled"
+
+	log := service.log.With(slog.String("op", op))
+
+	err := service.throttle.Check(ctx, keys...)
+	if err != nil {
+		if errors.Is(err, ErrTooManyAttempts) {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	tokens, err := attempt()
+	switch {
+	case errors.Is(err, ErrWrongCred), errors.Is(err, ErrTokenReused), errors.Is(err, repository.ErrUserNotFound):
+		if err := service.throttle.Failure(ctx, keys...); err != nil {
+			log.Error("can't register failed attempt", slog.String("err", err.Error()))
+		}
+	case err == nil:
+		var userKeys []string
+		for _, key := range keys {
+			if !strings.HasPrefix(key, throttleKeyIP) {
+				userKeys = append(userKeys, key)
+			}
+		}
+		if err := service.throttle.Success(ctx, userKeys...); err != nil {
+			log.Error("can't reset failed attempts", slog.String("err", err.Error()))
+		}
+	}
+
+	return tokens, err
+}
+
+// authenticate finds user by login and checks password. Password of unknown user or user without password
+// is compared with dummy hash, so response time doesn't reveal whether login exists
+func (service *AuthService) authenticate(ctx context.Context, login string, password string) (*model.User, error) {
+	const op = "internal.services.auth.authenticate"
+
+	user, err := service.userRepo.FindByLogin(ctx, login)
+	if err != nil && !errors.Is(err, repository.ErrUserNotFound) {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if user == nil || user.PasswordHash == "" {
+		dummyHash, err := service.getDummyHash(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		_, err = service.hasher.CompareHash(ctx, dummyHash, password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		return nil, ErrWrongCred
+	}
+
+	ok, err := service.hasher.CompareHash(ctx, user.PasswordHash, password)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if !ok {
+		return nil, ErrWrongCred
+	}
+
+	if service.hasher.NeedsRehash(user.PasswordHash) {
+		service.rehashPassword(ctx, user, password)
+	}
+
+	return user, nil
+}
+
+// rehashPassword replaces hash created with outdated algorithm or parameters. Password is known only on sign-in,
+// so it's the only time hash can be upgraded. Failure doesn't affect sign-in, hash is upgraded next time
+func (service *AuthService) rehashPassword(ctx context.Context, user *model.User, password string) {
+	const op = "internal.services.auth.rehashPassword"
+
+	log := service.log.With(slog.String("op", op), slog.String("guid", user.GUID))
+
+	hash, err := service.hasher.Hash(ctx, password)
+	if err != nil {
+		log.Error("can't rehash password", slog.String("err", err.Error()))
+		return
+	}
+
+	err = service.userRepo.UpdatePasswordHash(ctx, user.GUID, user.PasswordHash, hash)
+	if err != nil {
+		log.Error("can't update password hash", slog.String("err", err.Error()))
+		return
+	}
+
+	user.PasswordHash = hash
+	log.Info("password is rehashed")
+}
+
+// getDummyHash returns hash of random password. It's created on first use with the same hasher as real passwords,
+// so comparison with it costs the same
+func (service *AuthService) getDummyHash(ctx context.Context) (string, error) {
+	const op = "internal.services.auth.getDummyHash"
+
+	service.dummyHashMu.Lock()
+	defer service.dummyHashMu.Unlock()
+
+	if service.dummyHash != "" {
+		return service.dummyHash, nil
+	}
+
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	hash, err := service.hasher.Hash(ctx, hex.EncodeToString(password))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	service.dummyHash = hash
+
+	return service.dummyHash, nil
+}
+
+// findClient returns client allowed to use grant. Default client is found if clientID is empty,
+// ErrInvalidClient is returned if there is no default one
+func (service *AuthService) findClient(ctx context.Context, clientID string, grant string) (*model.Client, error) {
+	const op = "internal.services.auth.findClient"
+
+	if clientID == "" {
+		clientID = service.defaultClientID
+	}
+	if clientID == "" {
+		return nil, ErrInvalidClient
+	}
+
+	client, err := service.clientRepo.FindByClientID(ctx, clientID)
+	if err != nil {
+		if errors.Is(err, repository.ErrClientNotFound) {
+			return nil, ErrInvalidClient
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if !client.AllowsGrant(grant) {
+		return nil, ErrUnauthorizedClient
+	}
+
+	return client, nil
+}
+
+// warnAboutNewIP sends warning email to user. Failure to notify doesn't fail refresh, so errors are only logged
+func (service *AuthService) warnAboutNewIP(ctx context.Context, user *model.User, oldIP string, newIP string) {
+	const op = "internal.services.auth.warnAboutNewIP"
+
+	log := service.log.With(slog.String("op", op), slog.String("guid", user.GUID))
+
+	if user.Email == "" {
+		log.Info("user doesn't have email, warning isn't sent")
+		return
+	}
+
+	err := service.mailSender.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "New sign-in to your account",
+		Body: fmt.Sprintf(
+			"Your session was refreshed from IP address %s, which differs from %s it was started from.\r\n"+
+				"If it wasn't you, sign out of all sessions and contact support.",
+			newIP, oldIP,
+		),
+	})
+	if err != nil {
+		log.Error("can't send warning email", slog.String("err", err.Error()))
+	}
+}
+
+// getTokensPair creates tokens for user and refresh session described by session. Session is bound to client and its TTLs are used.
+// User, client and token related fields of session are filled here. nonce is put into id_token if it's issued
+func (service *AuthService) getTokensPair(
+	ctx context.Context,
+	user *model.User,
+	client *model.Client,
+	session CreateRefreshSessionInput,
+	nonce string,
+) (*auth.Tokens, error) {
 	const op = "internal.services.auth.getTokensPair"
 
-	tokens, err := service.tokenManager.CreateTokensPair(GUID, service.accessTokenTTL, service.refreshTokenTTL)
+	scopes := user.Permissions
+	accessTokenTTL, refreshTokenTTL := client.TokenTTLs(service.accessTokenTTL, service.refreshTokenTTL)
+	session.ClientID = client.ClientID
+	// family id is known before tokens are created, so it can be put into sid claim
+	if session.FamilyID == "" {
+		session.FamilyID = primitive.NewObjectID().Hex()
+	}
+	// sessions started with authorization code are limited to scopes granted to client,
+	// first-party ones may also manage user's sessions
+	if session.Grant == model.GrantAuthorizationCode {
+		scopes = userScopes(user, session.Scopes)
+	} else if !slices.Contains(scopes, model.ScopeSessions) {
+		scopes = append(slices.Clone(scopes), model.ScopeSessions)
+	}
+
+	authTime := session.CreatedAt
+	if authTime.IsZero() {
+		authTime = time.Now()
+	}
+
+	tokens, err := service.tokenManager.CreateTokensPair(auth.TokenParams{
+		Subject:         user.GUID,
+		ClientID:        session.ClientID,
+		IP:              session.IP,
+		Roles:           user.Roles,
+		Scopes:          scopes,
+		SessionID:       session.FamilyID,
+		TokenVersion:    user.TokenVersion,
+		AccessTokenTTL:  accessTokenTTL,
+		RefreshTokenTTL: refreshTokenTTL,
+		Nonce:           nonce,
+		AuthTime:        authTime,
+		Email:           user.Email,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	hashedRefreshToken, err := service.hasher.Hash(tokens.RefreshToken)
+	// only verifier is secret, selector is stored as is to find session
+	hashedRefreshToken, err := service.hasher.Hash(ctx, tokens.RefreshVerifier)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = service.refreshSessionService.CreateRefreshSession(ctx, GUID, hashedRefreshToken, service.refreshTokenTTL)
+	session.GUID = user.GUID
+	session.TokenVersion = user.TokenVersion
+	session.Selector = tokens.RefreshSelector
+	session.RefreshToken = hashedRefreshToken
+	session.AccessTokenID = tokens.AccessTokenID
+	session.TTL = refreshTokenTTL
+
+	err = service.refreshSessionService.CreateRefreshSession(ctx, session)
 	if err != nil {
 		if errors.Is(err, repository.ErrSessionAlreadyExists) {
 			return nil, repository.ErrSessionAlreadyExists
@@ -153,9 +821,31 @@ func (service *AuthService) decodeBase64Token(base64token string) ([]byte, error
 	return token, nil
 }
 
+// parseRefreshToken decodes refresh token into selector and verifier.
+// For legacy "guid-hex" tokens selector is empty, verifier is the whole token and GUID is taken from token.
+// Such tokens aren't issued anymore and are accepted until they expire
+func (service *AuthService) parseRefreshToken(base64token string) (GUID string, selector string, verifier string, err error) {
+	token, err := service.decodeBase64Token(base64token)
+	if err != nil {
+		return "", "", "", ErrWrongCred
+	}
+
+	if selector, verifier, ok := auth.SplitRefreshToken(string(token)); ok {
+		return "", selector, verifier, nil
+	}
+
+	GUID, err = service.getGUIDFromToken(token)
+	if err != nil {
+		return "", "", "", ErrWrongCred
+	}
+
+	return GUID, "", string(token), nil
+}
+
+// getGUIDFromToken extracts GUID from legacy "guid-hex" refresh token
 func (service *AuthService) getGUIDFromToken(token []byte) (string, error) {
 	delimiterIndex := strings.LastIndexAny(string(token), "-")
-	if delimiterIndex < 0 {
+	if delimiterIndex <= 0 {
 		return "", ErrWrongCred
 	}
 
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+)
+
+var (
+	ErrInvalidClient      = errors.New("invalid client")
+	ErrInvalidScope       = errors.New("invalid scope")
+	ErrUnauthorizedClient = errors.New("client isn't allowed to use grant type")
+)
+
+type clientRepository interface {
+	FindByClientID(ctx context.Context, clientID string) (*model.Client, error)
+}
+
+type ClientService struct {
+	clientRepo clientRepository
+
+	hasher hasher
+}
+
+func NewClientService(
+	clientRepo clientRepository,
+	hasher hasher,
+) *ClientService {
+	return &ClientService{
+		clientRepo: clientRepo,
+		hasher:     hasher,
+	}
+}
+
+// Authenticate checks client credentials. Public clients are identified by client id only and must not send secret.
+// ErrInvalidClient is returned if client doesn't exist or secret is wrong
+func (service *ClientService) Authenticate(ctx context.Context, clientID string, secret string) (*model.Client, error) {
+	const op = "internal.services.client.Authenticate"
+
+	client, err := service.FindClient(ctx, clientID)
+	if err != nil {
+		if errors.Is(err, ErrInvalidClient) {
+			return nil, ErrInvalidClient
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if client.IsPublic() {
+		if secret != "" {
+			return nil, ErrInvalidClient
+		}
+		return client, nil
+	}
+
+	if secret == "" {
+		return nil, ErrInvalidClient
+	}
+
+	ok, err := service.hasher.CompareHash(ctx, client.SecretHash, secret)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if !ok {
+		return nil, ErrInvalidClient
+	}
+
+	return client, nil
+}
+
+// FindClient returns client without authentication, e.g. for authorization request. ErrInvalidClient is returned if client doesn't exist
+func (service *ClientService) FindClient(ctx context.Context, clientID string) (*model.Client, error) {
+	const op = "internal.services.client.FindClient"
+
+	client, err := service.clientRepo.FindByClientID(ctx, clientID)
+	if err != nil {
+		if errors.Is(err, repository.ErrClientNotFound) {
+			return nil, ErrInvalidClient
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return client, nil
+}
+
+// grantedScopes returns requested scopes if client is allowed to get all of them or every allowed scope if nothing is requested
+func grantedScopes(allowed []string, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+
+	for _, scope := range requested {
+		if !slices.Contains(allowed, scope) {
+			return nil, ErrInvalidScope
+		}
+	}
+
+	return requested, nil
+}
+
+// userScopes drops privileged scopes user doesn't have permission for, so client can't get more access than user has
+func userScopes(user *model.User, scopes []string) []string {
+	granted := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if model.IsPrivilegedScope(scope) && !user.HasPermission(scope) {
+			continue
+		}
+		granted = append(granted, scope)
+	}
+
+	return granted
+}
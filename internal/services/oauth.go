@@ -0,0 +1,389 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrInvalidCodeChallenge = errors.New("code challenge is missing or invalid")
+
+type AuthAuthorizeInput struct {
+	GUID        string
+	Client      *model.Client
+	RedirectURI string
+	// RedirectURIProvided is set if redirect_uri parameter was sent, otherwise RedirectURI is the registered one
+	RedirectURIProvided bool
+	Scopes              []string
+	// CodeChallenge and CodeChallengeMethod are PKCE parameters, RFC 7636. Only S256 method is accepted
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// Nonce is OpenID Connect nonce, it's returned in id_token
+	Nonce string
+}
+
+// Authorize issues authorization code for user and client allowed to use authorization_code grant. Code is valid once and only for authCodeTTL.
+// Redirect URI must be already validated against client
+func (service *AuthService) Authorize(ctx context.Context, input AuthAuthorizeInput) (string, error) {
+	const op = "internal.services.auth.Authorize"
+
+	if !input.Client.AllowsGrant(model.GrantAuthorizationCode) {
+		return "", ErrUnauthorizedClient
+	}
+
+	if !auth.ValidCodeChallenge(input.CodeChallenge, input.CodeChallengeMethod) {
+		return "", ErrInvalidCodeChallenge
+	}
+
+	scopes, err := grantedScopes(input.Client.Scopes, input.Scopes)
+	if err != nil {
+		return "", ErrInvalidScope
+	}
+
+	user, err := service.userRepo.FindByGUID(ctx, input.GUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return "", ErrWrongCred
+		}
+
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := checkUserStatus(user); err != nil {
+		return "", err
+	}
+
+	code, err := service.tokenManager.CreateAuthorizationCode()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := time.Now()
+	err = service.authCodeRepo.Insert(ctx, model.AuthorizationCode{
+		CodeHash:            hashAuthorizationCode(code),
+		ClientID:            input.Client.ClientID,
+		GUID:                user.GUID,
+		RedirectURI:         input.RedirectURI,
+		RedirectURIProvided: input.RedirectURIProvided,
+		Scopes:              scopes,
+		CodeChallenge:       input.CodeChallenge,
+		CodeChallengeMethod: input.CodeChallengeMethod,
+		Nonce:               input.Nonce,
+		CreatedAt:           primitive.NewDateTimeFromTime(now),
+		ExpiresAt:           primitive.NewDateTimeFromTime(now.Add(service.authCodeTTL)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return code, nil
+}
+
+type AuthExchangeCodeInput struct {
+	Client       *model.Client
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	IP           string
+	UserAgent    string
+}
+
+// ExchangeCode redeems authorization code for tokens pair. Code is deleted on the first attempt, so even failed
+// exchange makes it unusable. ErrWrongCred is returned for unknown, expired or foreign code and wrong code verifier
+func (service *AuthService) ExchangeCode(ctx context.Context, input AuthExchangeCodeInput) (*auth.Tokens, error) {
+	const op = "internal.services.auth.ExchangeCode"
+
+	if !input.Client.AllowsGrant(model.GrantAuthorizationCode) {
+		return nil, ErrUnauthorizedClient
+	}
+
+	code, err := service.authCodeRepo.Redeem(ctx, hashAuthorizationCode(input.Code))
+	if err != nil {
+		if errors.Is(err, repository.ErrAuthCodeNotFound) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// TTL index removes expired codes with a delay, so expiration is checked here as well
+	if time.Now().After(code.ExpiresAt.Time()) {
+		return nil, ErrWrongCred
+	}
+
+	if code.ClientID != input.Client.ClientID {
+		return nil, ErrWrongCred
+	}
+
+	// redirect_uri is required only if it was sent to authorization endpoint, RFC 6749 section 4.1.3
+	if (code.RedirectURIProvided || input.RedirectURI != "") && code.RedirectURI != input.RedirectURI {
+		return nil, ErrWrongCred
+	}
+
+	if !auth.VerifyCodeChallenge(input.CodeVerifier, code.CodeChallenge, code.CodeChallengeMethod) {
+		return nil, ErrWrongCred
+	}
+
+	user, err := service.userRepo.FindByGUID(ctx, code.GUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := checkUserStatus(user); err != nil {
+		return nil, err
+	}
+
+	tokens, err := service.getTokensPair(ctx, user, input.Client, CreateRefreshSessionInput{
+		Grant:       model.GrantAuthorizationCode,
+		Scopes:      code.Scopes,
+		IP:          input.IP,
+		UserAgent:   input.UserAgent,
+		DeviceLabel: input.Client.Name,
+		// user authenticated when code was issued
+		CreatedAt: code.CreatedAt.Time(),
+	}, code.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return tokens, nil
+}
+
+// hashAuthorizationCode returns SHA-256 of code. Code has enough entropy, so slow hash isn't needed and
+// stored hash can be used to find the code
+func hashAuthorizationCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Token type hints of introspection request, RFC 7662 section 2.1
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// Introspection describes token state. Only Active is set for inactive token
+type Introspection struct {
+	Active    bool
+	TokenType string
+	Subject   string
+	ClientID  string
+	SessionID string
+	Scope     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// Introspect returns state of access or refresh token. Access token is active if it's valid, isn't denylisted,
+// session it was issued with isn't revoked and user's token version wasn't increased, refresh token is active if its session can be refreshed.
+// hint only defines which token type is checked first
+func (service *AuthService) Introspect(ctx context.Context, token string, hint string) (*Introspection, error) {
+	const op = "internal.services.auth.Introspect"
+
+	introspectors := []func(ctx context.Context, token string) (*Introspection, error){
+		service.introspectAccessToken,
+		service.introspectRefreshToken,
+	}
+	if hint == TokenTypeHintRefreshToken {
+		slices.Reverse(introspectors)
+	}
+
+	for _, introspect := range introspectors {
+		introspection, err := introspect(ctx, token)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if introspection.Active {
+			return introspection, nil
+		}
+	}
+
+	return &Introspection{Active: false}, nil
+}
+
+func (service *AuthService) introspectAccessToken(ctx context.Context, token string) (*Introspection, error) {
+	const op = "internal.services.auth.introspectAccessToken"
+
+	claims, err := service.tokenManager.Parse(token)
+	if err != nil {
+		return &Introspection{Active: false}, nil
+	}
+
+	revoked, err := service.tokenDenylist.IsRevoked(ctx, claims.Id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if revoked {
+		return &Introspection{Active: false}, nil
+	}
+
+	if claims.SessionID != "" {
+		active, err := service.refreshSessionService.IsFamilyActive(ctx, claims.SessionID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if !active {
+			return &Introspection{Active: false}, nil
+		}
+
+		user, err := service.userRepo.FindByGUID(ctx, claims.Subject)
+		if err != nil {
+			if errors.Is(err, repository.ErrUserNotFound) {
+				return &Introspection{Active: false}, nil
+			}
+
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if claims.TokenVersion < user.TokenVersion {
+			return &Introspection{Active: false}, nil
+		}
+	}
+
+	return &Introspection{
+		Active:    true,
+		TokenType: TokenTypeHintAccessToken,
+		Subject:   claims.Subject,
+		ClientID:  claims.ClientID,
+		SessionID: claims.SessionID,
+		Scope:     claims.Scope,
+		IssuedAt:  time.Unix(claims.IssuedAt, 0),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
+
+func (service *AuthService) introspectRefreshToken(ctx context.Context, token string) (*Introspection, error) {
+	const op = "internal.services.auth.introspectRefreshToken"
+
+	session, err := service.findSessionByToken(ctx, token)
+	if err != nil {
+		if errors.Is(err, ErrWrongCred) {
+			return &Introspection{Active: false}, nil
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	introspection := &Introspection{
+		Active:    true,
+		TokenType: TokenTypeHintRefreshToken,
+		Subject:   session.GUID,
+		ClientID:  session.ClientID,
+		SessionID: session.FamilyID,
+		IssuedAt:  session.LastUsedAt.Time(),
+		ExpiresAt: session.ExpiresIn.Time(),
+	}
+	if introspection.SessionID == "" {
+		introspection.SessionID = familyOf(session)
+	}
+	if session.Grant == model.GrantAuthorizationCode {
+		introspection.Scope = strings.Join(session.Scopes, " ")
+	}
+
+	return introspection, nil
+}
+
+// Revoke revokes access token by adding it to denylist or refresh token by deleting its session family.
+// Client may revoke only tokens issued to it unless it's allowed tokens:revoke scope.
+// Unknown, invalid and expired tokens are ignored, as RFC 7009 requires
+func (service *AuthService) Revoke(ctx context.Context, client *model.Client, token string, hint string) error {
+	const op = "internal.services.auth.Revoke"
+
+	revokers := []func(ctx context.Context, client *model.Client, token string) (bool, error){
+		service.revokeAccessToken,
+		service.revokeRefreshToken,
+	}
+	if hint == TokenTypeHintRefreshToken {
+		slices.Reverse(revokers)
+	}
+
+	for _, revoke := range revokers {
+		revoked, err := revoke(ctx, client, token)
+		if err != nil {
+			if errors.Is(err, ErrUnauthorizedClient) {
+				return ErrUnauthorizedClient
+			}
+
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if revoked {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (service *AuthService) revokeAccessToken(ctx context.Context, client *model.Client, token string) (bool, error) {
+	const op = "internal.services.auth.revokeAccessToken"
+
+	claims, err := service.tokenManager.Parse(token)
+	if err != nil {
+		return false, nil
+	}
+
+	if !canRevoke(client, claims.ClientID) {
+		return false, ErrUnauthorizedClient
+	}
+
+	err = service.tokenDenylist.Revoke(ctx, claims.Id, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// refresh token issued together with access token is revoked too, otherwise it gives new access token
+	if claims.SessionID != "" {
+		err = service.refreshSessionService.DeleteSessionFamily(ctx, claims.SessionID)
+		if err != nil && !errors.Is(err, repository.ErrSessionNotFound) {
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return true, nil
+}
+
+func (service *AuthService) revokeRefreshToken(ctx context.Context, client *model.Client, token string) (bool, error) {
+	const op = "internal.services.auth.revokeRefreshToken"
+
+	session, err := service.findSessionByToken(ctx, token)
+	if err != nil {
+		if errors.Is(err, ErrWrongCred) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if !canRevoke(client, session.ClientID) {
+		return false, ErrUnauthorizedClient
+	}
+
+	err = service.refreshSessionService.DeleteSession(ctx, session)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return true, nil
+}
+
+// canRevoke reports whether client may revoke token issued to tokenClientID
+func canRevoke(client *model.Client, tokenClientID string) bool {
+	if tokenClientID != "" && tokenClientID == client.ClientID {
+		return true
+	}
+
+	return !client.IsPublic() && client.HasScope(model.ScopeTokensRevoke)
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// errRotatedWithinGrace is returned by ValidateRefreshSession together with session which was rotated within grace
+// period for the same caller. Caller gets tokens pair the token was exchanged for instead of reuse detection
+var errRotatedWithinGrace = errors.New("refresh token was rotated within grace period")
+
+// refreshGracePollInterval is how often rotated session is checked while concurrent rotation,
+// possibly on another instance, hasn't stored its tokens pair yet
+const refreshGracePollInterval = 50 * time.Millisecond
+
+// SetSuccessor stores sealed tokens pair rotated session was exchanged for, so requests which present the same token
+// within grace period get the same pair on any instance. The pair is kept only for grace period, expired pairs
+// of earlier rotations of the family are removed. Nothing is stored if grace period is disabled
+func (service *RefreshSessionService) SetSuccessor(ctx context.Context, session *model.RefreshSession, successor []byte) error {
+	const op = "internal.services.refresh_session.SetSuccessor"
+
+	if service.refreshGracePeriod <= 0 {
+		return nil
+	}
+
+	err := service.refreshSessionRepo.SetSuccessor(ctx, session.ID, successor, time.Now().Add(service.refreshGracePeriod))
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			return repository.ErrSessionNotFound
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = service.refreshSessionRepo.UnsetExpiredSuccessors(ctx, familyOf(session))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// WaitSuccessor returns sealed tokens pair session rotated within grace period was exchanged for.
+// Rotation may still be running, so session is polled until the pair is stored. If it isn't stored by the end
+// of grace period, rotation failed to store it and ErrWrongCred is returned. Family isn't revoked then:
+// the caller is the one token was issued to, and the concurrent rotation may have succeeded.
+// ErrWrongCred is returned as well if family was revoked meanwhile
+func (service *RefreshSessionService) WaitSuccessor(ctx context.Context, session *model.RefreshSession) ([]byte, error) {
+	const op = "internal.services.refresh_session.WaitSuccessor"
+
+	ticker := time.NewTicker(refreshGracePollInterval)
+	defer ticker.Stop()
+
+	for !session.HasSuccessor() {
+		if !service.isWithinGrace(session) {
+			return nil, ErrWrongCred
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s: %w", op, ctx.Err())
+		}
+
+		var err error
+		session, err = service.refreshSessionRepo.FindByID(ctx, session.ID)
+		if err != nil {
+			if errors.Is(err, repository.ErrSessionNotFound) {
+				return nil, ErrWrongCred
+			}
+
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return session.Successor, nil
+}
+
+// isWithinGrace reports whether session was rotated less than grace period ago
+func (service *RefreshSessionService) isWithinGrace(session *model.RefreshSession) bool {
+	return time.Now().Before(session.RotatedAt.Time().Add(service.refreshGracePeriod))
+}
+
+// sealTokens encrypts tokens pair rotated session was exchanged for with key derived from verifier of rotated token.
+// Database keeps only hash of verifier, so stored pair can be opened only by request presenting the rotated token
+func sealTokens(tokens *auth.Tokens, verifier string, sessionID primitive.ObjectID) ([]byte, error) {
+	const op = "internal.services.refresh_grace.sealTokens"
+
+	plaintext, err := json.Marshal(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	aead, err := successorCipher(verifier)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, sessionID[:]), nil
+}
+
+// openTokens decrypts tokens pair sealed by sealTokens
+func openTokens(sealed []byte, verifier string, sessionID primitive.ObjectID) (*auth.Tokens, error) {
+	const op = "internal.services.refresh_grace.openTokens"
+
+	aead, err := successorCipher(verifier)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s: sealed tokens are too short", op)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, sessionID[:])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var tokens auth.Tokens
+	if err := json.Unmarshal(plaintext, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &tokens, nil
+}
+
+func successorCipher(verifier string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("refresh successor\x00" + verifier))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"github.com/4aykovksi/medods_test_task/pkg/lib/auth"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRotatedTokenWithinGraceGetsSamePair(t *testing.T) {
+	sessions := newMemorySessionRepository()
+	events := &memorySecurityEventRepository{}
+	service := newGraceTestService(sessions, events, time.Minute)
+	input := insertGraceTestSession(t, sessions, 0)
+
+	session, err := service.ValidateRefreshSession(context.Background(), input)
+	if err != nil {
+		t.Fatalf("first refresh failed: %v", err)
+	}
+
+	// second request comes while the first one is still issuing tokens, maybe on another instance
+	again, err := service.ValidateRefreshSession(context.Background(), input)
+	if !errors.Is(err, errRotatedWithinGrace) {
+		t.Fatalf("second refresh within grace period returned %v, want errRotatedWithinGrace", err)
+	}
+
+	tokens := &auth.Tokens{AccessToken: "access", RefreshToken: "refresh"}
+	go func() {
+		time.Sleep(2 * refreshGracePollInterval)
+
+		successor, err := sealTokens(tokens, input.Verifier, session.ID)
+		if err == nil {
+			err = service.SetSuccessor(context.Background(), session, successor)
+		}
+		if err != nil {
+			t.Errorf("can't store successor: %v", err)
+		}
+	}()
+
+	successor, err := service.WaitSuccessor(context.Background(), again)
+	if err != nil {
+		t.Fatalf("can't get successor: %v", err)
+	}
+	got, err := openTokens(successor, input.Verifier, session.ID)
+	if err != nil {
+		t.Fatalf("can't open successor: %v", err)
+	}
+
+	if got.AccessToken != tokens.AccessToken || got.RefreshToken != tokens.RefreshToken {
+		t.Errorf("got pair %+v, want %+v", got, tokens)
+	}
+	if events.count() != 0 {
+		t.Error("refresh within grace period is recorded as reuse")
+	}
+	if _, err := openTokens(successor, "other verifier", session.ID); err == nil {
+		t.Error("successor is opened without rotated token")
+	}
+}
+
+func TestRotatedTokenAfterGraceIsReuse(t *testing.T) {
+	sessions := newMemorySessionRepository()
+	events := &memorySecurityEventRepository{}
+	service := newGraceTestService(sessions, events, time.Minute)
+	input := insertGraceTestSession(t, sessions, 2*time.Minute)
+
+	_, err := service.ValidateRefreshSession(context.Background(), input)
+	if !errors.Is(err, ErrTokenReused) {
+		t.Fatalf("refresh after grace period returned %v, want ErrTokenReused", err)
+	}
+
+	assertFamilyRevoked(t, sessions, events)
+}
+
+func TestRotatedTokenWithinGraceWithOtherAccessTokenIsReuse(t *testing.T) {
+	sessions := newMemorySessionRepository()
+	events := &memorySecurityEventRepository{}
+	service := newGraceTestService(sessions, events, time.Minute)
+	input := insertGraceTestSession(t, sessions, time.Second)
+
+	input.AccessTokenID = "other access"
+	_, err := service.ValidateRefreshSession(context.Background(), input)
+	if !errors.Is(err, ErrTokenReused) {
+		t.Fatalf("refresh with other access token returned %v, want ErrTokenReused", err)
+	}
+
+	assertFamilyRevoked(t, sessions, events)
+}
+
+func TestRotatedTokenWithoutSuccessorIsRejectedAfterGrace(t *testing.T) {
+	const grace = 3 * refreshGracePollInterval
+
+	sessions := newMemorySessionRepository()
+	events := &memorySecurityEventRepository{}
+	service := newGraceTestService(sessions, events, grace)
+	input := insertGraceTestSession(t, sessions, 0)
+
+	if _, err := service.ValidateRefreshSession(context.Background(), input); err != nil {
+		t.Fatalf("first refresh failed: %v", err)
+	}
+
+	// the first request fails after rotation and never stores its pair
+	session, err := service.ValidateRefreshSession(context.Background(), input)
+	if !errors.Is(err, errRotatedWithinGrace) {
+		t.Fatalf("second refresh within grace period returned %v, want errRotatedWithinGrace", err)
+	}
+
+	_, err = service.WaitSuccessor(context.Background(), session)
+	if !errors.Is(err, ErrWrongCred) {
+		t.Fatalf("waiting for missing successor returned %v, want ErrWrongCred", err)
+	}
+
+	// the first request may have issued tokens, so family stays
+	if events.count() != 0 {
+		t.Error("missing successor is recorded as reuse")
+	}
+	if _, err := sessions.FindBySelector(context.Background(), "selector"); err != nil {
+		t.Errorf("family is revoked: %v", err)
+	}
+}
+
+func TestExpiredSuccessorIsIgnored(t *testing.T) {
+	sessions := newMemorySessionRepository()
+	events := &memorySecurityEventRepository{}
+	service := newGraceTestService(sessions, events, time.Minute)
+	input := insertGraceTestSession(t, sessions, 0)
+
+	session, err := service.ValidateRefreshSession(context.Background(), input)
+	if err != nil {
+		t.Fatalf("first refresh failed: %v", err)
+	}
+
+	successor, err := sealTokens(&auth.Tokens{AccessToken: "access"}, input.Verifier, session.ID)
+	if err != nil {
+		t.Fatalf("can't seal successor: %v", err)
+	}
+	err = sessions.SetSuccessor(context.Background(), session.ID, successor, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("can't store successor: %v", err)
+	}
+
+	if err := sessions.UnsetExpiredSuccessors(context.Background(), "family"); err != nil {
+		t.Fatalf("can't unset expired successors: %v", err)
+	}
+	stored, err := sessions.FindByID(context.Background(), session.ID)
+	if err != nil {
+		t.Fatalf("can't find session: %v", err)
+	}
+	if stored.Successor != nil {
+		t.Error("expired successor isn't unset")
+	}
+
+	stored.Successor = successor
+	ctx, cancel := context.WithTimeout(context.Background(), 2*refreshGracePollInterval)
+	defer cancel()
+	if _, err := service.WaitSuccessor(ctx, stored); err == nil {
+		t.Error("expired successor is returned")
+	}
+}
+
+func newGraceTestService(sessions *memorySessionRepository, events *memorySecurityEventRepository, grace time.Duration) *RefreshSessionService {
+	users := memoryUserRepository{"user": {GUID: "user"}}
+
+	return NewRefreshSessionService(sessions, events, users, plainHasher{}, 5, grace)
+}
+
+// insertGraceTestSession inserts session of family "family". If rotatedAgo isn't zero, session is already rotated
+// that long ago. Input to refresh the session is returned
+func insertGraceTestSession(t *testing.T, sessions *memorySessionRepository, rotatedAgo time.Duration) ValidateRefreshSessionInput {
+	t.Helper()
+
+	now := time.Now()
+	session := model.RefreshSession{
+		GUID:          "user",
+		FamilyID:      "family",
+		Selector:      "selector",
+		RefreshToken:  "verifier",
+		AccessTokenID: "access",
+		CreatedAt:     primitive.NewDateTimeFromTime(now),
+		LastUsedAt:    primitive.NewDateTimeFromTime(now),
+		ExpiresIn:     primitive.NewDateTimeFromTime(now.Add(time.Hour)),
+	}
+	if rotatedAgo != 0 {
+		session.RotatedAt = primitive.NewDateTimeFromTime(now.Add(-rotatedAgo))
+	}
+	if err := sessions.Insert(context.Background(), session); err != nil {
+		t.Fatalf("can't insert session: %v", err)
+	}
+
+	return ValidateRefreshSessionInput{
+		GUID:          "user",
+		AccessTokenID: "access",
+		Selector:      "selector",
+		Verifier:      "verifier",
+	}
+}
+
+func assertFamilyRevoked(t *testing.T, sessions *memorySessionRepository, events *memorySecurityEventRepository) {
+	t.Helper()
+
+	if events.count() == 0 {
+		t.Error("reuse isn't recorded")
+	}
+	if _, err := sessions.FindBySelector(context.Background(), "selector"); !errors.Is(err, repository.ErrSessionNotFound) {
+		t.Error("family isn't revoked after reuse")
+	}
+}
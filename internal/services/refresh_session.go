@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sort"
 	"time"
 
 	"github.com/4aykovksi/medods_test_task/internal/model"
@@ -13,55 +12,131 @@ import (
 )
 
 var (
-	ErrWrongCred = errors.New("wrong credentials")
+	ErrWrongCred   = errors.New("wrong credentials")
+	ErrTokenReused = errors.New("refresh token reuse detected")
 )
 
 type refreshSessionRepository interface {
 	Insert(ctx context.Context, session model.RefreshSession) error
 	DeleteByToken(ctx context.Context, token string) error
-	FindAllUserSessions(ctx context.Context, GUID string) ([]model.RefreshSession, error)
+	DeleteByID(ctx context.Context, id primitive.ObjectID) error
+	DeleteByFamily(ctx context.Context, familyID string) error
+	DeleteAllUserSessions(ctx context.Context, GUID string) error
+	DeleteAllUserSessionsExcept(ctx context.Context, GUID string, id primitive.ObjectID, familyID string) error
+	MarkRotated(ctx context.Context, id primitive.ObjectID) error
+	SetSuccessor(ctx context.Context, id primitive.ObjectID, successor []byte, expiresAt time.Time) error
+	UnsetExpiredSuccessors(ctx context.Context, familyID string) error
+	DeleteExcessUserSessions(ctx context.Context, GUID string, id primitive.ObjectID, keep int64) error
+	FindActiveUserSessions(ctx context.Context, GUID string, offset int64, limit int64) ([]model.RefreshSession, int64, error)
+	FindBySelector(ctx context.Context, selector string) (*model.RefreshSession, error)
+	FindLegacyUserSessions(ctx context.Context, GUID string) ([]model.RefreshSession, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (*model.RefreshSession, error)
+	FindActiveByFamily(ctx context.Context, familyID string) (*model.RefreshSession, error)
+}
+
+type sessionUserRepository interface {
+	FindByGUID(ctx context.Context, guid string) (*model.User, error)
+}
+
+type securityEventRepository interface {
+	Insert(ctx context.Context, event model.SecurityEvent) error
 }
 
 type RefreshSessionService struct {
 	refreshSessionRepo refreshSessionRepository
+	securityEventRepo  securityEventRepository
+	userRepo           sessionUserRepository
 
 	hasher hasher
 
 	maxSessionCount int
+	// refreshGracePeriod is time rotated token gets the same tokens pair instead of being treated as reused
+	refreshGracePeriod time.Duration
 }
 
 func NewRefreshSessionService(
 	repository refreshSessionRepository,
+	securityEventRepo securityEventRepository,
+	userRepo sessionUserRepository,
 	hasher hasher,
 	maxSessionCount int,
+	refreshGracePeriod time.Duration,
 ) *RefreshSessionService {
 	return &RefreshSessionService{
 		refreshSessionRepo: repository,
+		securityEventRepo:  securityEventRepo,
+		userRepo:           userRepo,
 		hasher:             hasher,
 		maxSessionCount:    maxSessionCount,
+		refreshGracePeriod: refreshGracePeriod,
 	}
 }
 
-func (service *RefreshSessionService) CreateRefreshSession(ctx context.Context, GUID string, token string, ttl time.Duration) error {
+type CreateRefreshSessionInput struct {
+	GUID string
+	// FamilyID links sessions created by rotation of one sign-in. New family is started if it's empty
+	FamilyID string
+	// ClientID is id of client the session is issued to
+	ClientID string
+	// Grant is grant type the family was started with, model.GrantSignIn for first-party sign-in
+	Grant string
+	// Scopes are scopes granted to OAuth client
+	Scopes []string
+	// TokenVersion is user's token version tokens are issued with
+	TokenVersion  int64
+	Selector      string
+	RefreshToken  string
+	AccessTokenID string
+	IP            string
+	UserAgent     string
+	DeviceLabel   string
+	// CreatedAt is time of sign-in the family was started with. Current time is used if it's zero
+	CreatedAt time.Time
+	TTL       time.Duration
+}
+
+// CreateRefreshSession inserts session and then evicts user's sessions which were used least recently, so user keeps
+// at most maxSessionCount active sessions. Eviction goes after insert, so concurrent sign-ins can't exceed the limit,
+// and never evicts the inserted session
+func (service *RefreshSessionService) CreateRefreshSession(ctx context.Context, input CreateRefreshSessionInput) error {
 	const op = "internal.services.refresh_session.CreateRefreshSession"
 
-	err := service.refreshSessionRepo.DeleteByToken(ctx, token)
-	if err != nil && !errors.Is(err, repository.ErrSessionNotFound) {
-		return fmt.Errorf("%s: %w", op, err)
-	} else if errors.Is(err, repository.ErrSessionNotFound) {
-		err = service.deleteExcessSession(ctx, GUID)
-		if err != nil && !errors.Is(err, repository.ErrUserSessionsNotFound) {
-			return fmt.Errorf("%s: %w", op, err)
-		}
+	familyID := input.FamilyID
+	if familyID == "" {
+		familyID = primitive.NewObjectID().Hex()
+	}
+
+	now := time.Now()
+	createdAt := input.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = now
 	}
 
 	session := model.RefreshSession{
-		RefreshToken: token,
-		GUID:         GUID,
-		ExpiresIn:    primitive.NewDateTimeFromTime(time.Now().Add(ttl)),
+		ID:            primitive.NewObjectID(),
+		FamilyID:      familyID,
+		ClientID:      input.ClientID,
+		Grant:         input.Grant,
+		Scopes:        input.Scopes,
+		TokenVersion:  input.TokenVersion,
+		Selector:      input.Selector,
+		RefreshToken:  input.RefreshToken,
+		AccessTokenID: input.AccessTokenID,
+		GUID:          input.GUID,
+		IP:            input.IP,
+		UserAgent:     input.UserAgent,
+		DeviceLabel:   input.DeviceLabel,
+		CreatedAt:     primitive.NewDateTimeFromTime(createdAt),
+		LastUsedAt:    primitive.NewDateTimeFromTime(now),
+		ExpiresIn:     primitive.NewDateTimeFromTime(now.Add(input.TTL)),
 	}
 
-	err = service.refreshSessionRepo.Insert(ctx, session)
+	err := service.refreshSessionRepo.Insert(ctx, session)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = service.refreshSessionRepo.DeleteExcessUserSessions(ctx, input.GUID, session.ID, int64(service.maxSessionCount))
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
@@ -69,68 +144,421 @@ func (service *RefreshSessionService) CreateRefreshSession(ctx context.Context,
 	return nil
 }
 
-func (service *RefreshSessionService) ValidateRefreshSession(ctx context.Context, GUID string, token string) error {
+type ValidateRefreshSessionInput struct {
+	// GUID is subject of access token the refresh token is presented with
+	GUID          string
+	AccessTokenID string
+	// ClientID is id of calling client, session must be issued to the same client
+	ClientID string
+	// ClientAuthenticated is true if client is authenticated with its credentials. Such sessions are bound to client
+	// instead of access token, because refresh_token grant doesn't carry access token
+	ClientAuthenticated bool
+	IP                  string
+	// Selector is empty for legacy "guid-hex" tokens, Verifier is the whole token then and GUID is taken from it
+	Selector string
+	Verifier string
+}
+
+// ValidateRefreshSession checks that token belongs to one of user's sessions and was issued
+// together with access token input.AccessTokenID. Session created before user's token version was increased is rejected.
+// Valid session is marked as rotated with single conditional update, so token can be used only once even by concurrent
+// requests: only one of them rotates session.
+// If token rotated within grace period is presented by the same caller, session is returned with errRotatedWithinGrace,
+// so the caller can get the pair it was exchanged for with WaitSuccessor. Otherwise already rotated token is reuse:
+// the whole session family is revoked and ErrTokenReused is returned
+func (service *RefreshSessionService) ValidateRefreshSession(ctx context.Context, input ValidateRefreshSessionInput) (*model.RefreshSession, error) {
 	const op = "internal.services.refresh_session.ValidateRefreshSession"
 
-	sessions, err := service.refreshSessionRepo.FindAllUserSessions(ctx, GUID)
+	session, err := service.findSession(ctx, input.GUID, input.Selector, input.Verifier)
 	if err != nil {
-		if errors.Is(err, repository.ErrUserSessionsNotFound) {
-			return ErrWrongCred
+		if errors.Is(err, ErrWrongCred) {
+			return nil, ErrWrongCred
 		}
 
-		return fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	session := service.getValidSession(sessions, token)
-	if session == nil {
-		return ErrWrongCred
+	if input.GUID != "" && session.GUID != input.GUID {
+		return nil, ErrWrongCred
 	}
 
-	err = service.refreshSessionRepo.DeleteByToken(ctx, session.RefreshToken)
-	if err != nil && !errors.Is(err, repository.ErrSessionNotFound) {
-		return fmt.Errorf("%s: %w", op, err)
+	if session.IsRotated() {
+		return service.rotatedSession(ctx, session, input)
+	}
+
+	if !isIssuedTo(session, input) {
+		return nil, ErrWrongCred
 	}
 
 	ok := service.isSessionNotExpired(session)
 	if !ok {
-		return ErrWrongCred
+		return nil, ErrWrongCred
+	}
+
+	user, err := service.userRepo.FindByGUID(ctx, session.GUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if session.TokenVersion < user.TokenVersion {
+		return nil, ErrWrongCred
+	}
+
+	err = service.refreshSessionRepo.MarkRotated(ctx, session.ID)
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			return service.lostRotation(ctx, session.ID, input)
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if session.FamilyID == "" {
+		session.FamilyID = familyOf(session)
+	}
+
+	return session, nil
+}
+
+// IsFamilyActive reports whether session family still has session which can be refreshed,
+// i.e. it's neither revoked nor expired
+func (service *RefreshSessionService) IsFamilyActive(ctx context.Context, familyID string) (bool, error) {
+	const op = "internal.services.refresh_session.IsFamilyActive"
+
+	_, err := service.refreshSessionRepo.FindActiveByFamily(ctx, familyID)
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return true, nil
+}
+
+// FindActiveSession returns session of refresh token if it's neither rotated nor expired.
+// GUID is used only for legacy token without selector
+func (service *RefreshSessionService) FindActiveSession(ctx context.Context, GUID string, selector string, verifier string) (*model.RefreshSession, error) {
+	const op = "internal.services.refresh_session.FindActiveSession"
+
+	session, err := service.findSession(ctx, GUID, selector, verifier)
+	if err != nil {
+		if errors.Is(err, ErrWrongCred) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if session.IsRotated() || !service.isSessionNotExpired(session) {
+		return nil, ErrWrongCred
+	}
+
+	return session, nil
+}
+
+// DeleteSession revokes session together with rotated sessions of its family
+func (service *RefreshSessionService) DeleteSession(ctx context.Context, session *model.RefreshSession) error {
+	const op = "internal.services.refresh_session.DeleteSession"
+
+	err := service.refreshSessionRepo.DeleteByFamily(ctx, familyOf(session))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = service.refreshSessionRepo.DeleteByID(ctx, session.ID)
+	if err != nil && !errors.Is(err, repository.ErrSessionNotFound) {
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
 	return nil
 }
 
-func (service *RefreshSessionService) deleteExcessSession(ctx context.Context, GUID string) error {
-	const op = "internal.services.refresh_session.deleteExcessSession"
+func (service *RefreshSessionService) DeleteAllUserSessions(ctx context.Context, GUID string) error {
+	const op = "internal.services.refresh_session.DeleteAllUserSessions"
 
-	sessions, err := service.refreshSessionRepo.FindAllUserSessions(ctx, GUID)
-	if err != nil && !errors.Is(err, repository.ErrUserSessionsNotFound) {
+	err := service.refreshSessionRepo.DeleteAllUserSessions(ctx, GUID)
+	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	if len(sessions) >= service.maxSessionCount {
-		sort.Slice(sessions, func(i, j int) bool { return sessions[i].ExpiresIn.Time().Before(sessions[j].ExpiresIn.Time()) })
+	return nil
+}
 
-		err = service.refreshSessionRepo.DeleteByToken(ctx, sessions[0].RefreshToken)
-		if err != nil {
+// DeleteOtherUserSessions revokes every user's session except given one and its family
+func (service *RefreshSessionService) DeleteOtherUserSessions(ctx context.Context, session *model.RefreshSession) error {
+	const op = "internal.services.refresh_session.DeleteOtherUserSessions"
+
+	err := service.refreshSessionRepo.DeleteAllUserSessionsExcept(ctx, session.GUID, session.ID, familyOf(session))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ListUserSessions returns page of user's active sessions, most recently used first, and total count of them
+func (service *RefreshSessionService) ListUserSessions(ctx context.Context, GUID string, offset int64, limit int64) ([]model.RefreshSession, int64, error) {
+	const op = "internal.services.refresh_session.ListUserSessions"
+
+	sessions, total, err := service.refreshSessionRepo.FindActiveUserSessions(ctx, GUID, offset, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return sessions, total, nil
+}
+
+// DeleteUserSession revokes user's session family by its id, which stays the same when session is refreshed.
+// ErrSessionNotFound is returned if user doesn't have such active session
+func (service *RefreshSessionService) DeleteUserSession(ctx context.Context, GUID string, familyID string) error {
+	const op = "internal.services.refresh_session.DeleteUserSession"
+
+	err := service.deleteSessionFamily(ctx, familyID, func(session *model.RefreshSession) bool {
+		return session.GUID == GUID
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			return repository.ErrSessionNotFound
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// DeleteSessionFamily revokes session family of any user by its id
+func (service *RefreshSessionService) DeleteSessionFamily(ctx context.Context, familyID string) error {
+	const op = "internal.services.refresh_session.DeleteSessionFamily"
+
+	err := service.deleteSessionFamily(ctx, familyID, func(*model.RefreshSession) bool { return true })
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			return repository.ErrSessionNotFound
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (service *RefreshSessionService) deleteSessionFamily(ctx context.Context, familyID string, allowed func(session *model.RefreshSession) bool) error {
+	const op = "internal.services.refresh_session.deleteSessionFamily"
+
+	session, err := service.findActiveSessionOfFamily(ctx, familyID)
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			return repository.ErrSessionNotFound
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if !allowed(session) {
+		return repository.ErrSessionNotFound
+	}
+
+	err = service.DeleteSession(ctx, session)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// findActiveSessionOfFamily returns active session of family. Session created before families were introduced
+// is the only one of its family, so it's found by id
+func (service *RefreshSessionService) findActiveSessionOfFamily(ctx context.Context, familyID string) (*model.RefreshSession, error) {
+	const op = "internal.services.refresh_session.findActiveSessionOfFamily"
+
+	session, err := service.refreshSessionRepo.FindActiveByFamily(ctx, familyID)
+	if err == nil {
+		return session, nil
+	}
+	if !errors.Is(err, repository.ErrSessionNotFound) {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	id, err := primitive.ObjectIDFromHex(familyID)
+	if err != nil {
+		return nil, repository.ErrSessionNotFound
+	}
+
+	session, err = service.refreshSessionRepo.FindByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			return nil, repository.ErrSessionNotFound
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if session.FamilyID != "" || session.IsRotated() || !service.isSessionNotExpired(session) {
+		return nil, repository.ErrSessionNotFound
+	}
+
+	return session, nil
+}
+
+// lostRotation handles session which was rotated or deleted by concurrent request after it had been validated.
+// Rotated session means token was redeemed twice, so it's handled like rotated token presented again
+func (service *RefreshSessionService) lostRotation(ctx context.Context, id primitive.ObjectID, input ValidateRefreshSessionInput) (*model.RefreshSession, error) {
+	const op = "internal.services.refresh_session.lostRotation"
+
+	session, err := service.refreshSessionRepo.FindByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if !session.IsRotated() {
+		return nil, ErrWrongCred
+	}
+
+	return service.rotatedSession(ctx, session, input)
+}
+
+// rotatedSession handles presented token which was already rotated. Within grace period session issued to the caller
+// is returned with errRotatedWithinGrace, otherwise session family is revoked and ErrTokenReused is returned
+func (service *RefreshSessionService) rotatedSession(ctx context.Context, session *model.RefreshSession, input ValidateRefreshSessionInput) (*model.RefreshSession, error) {
+	const op = "internal.services.refresh_session.rotatedSession"
+
+	if service.isWithinGrace(session) && isIssuedTo(session, input) {
+		return session, errRotatedWithinGrace
+	}
+
+	err := service.revokeFamily(ctx, session, input.IP)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil, ErrTokenReused
+}
+
+// revokeFamily deletes every session created by rotation of the same sign-in and records security event
+func (service *RefreshSessionService) revokeFamily(ctx context.Context, session *model.RefreshSession, IP string) error {
+	const op = "internal.services.refresh_session.revokeFamily"
+
+	familyID := familyOf(session)
+
+	err := service.refreshSessionRepo.DeleteByFamily(ctx, familyID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// sessions created before families were introduced don't have family id
+	if session.FamilyID == "" {
+		err = service.refreshSessionRepo.DeleteByToken(ctx, session.RefreshToken)
+		if err != nil && !errors.Is(err, repository.ErrSessionNotFound) {
 			return fmt.Errorf("%s: %w", op, err)
 		}
 	}
 
+	err = service.securityEventRepo.Insert(ctx, model.SecurityEvent{
+		Type:      model.SecurityEventRefreshTokenReuse,
+		GUID:      session.GUID,
+		FamilyID:  familyID,
+		IP:        IP,
+		Details:   "rotated refresh token was presented, session family is revoked",
+		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
 	return nil
 }
 
-func (service *RefreshSessionService) isSessionNotExpired(session *model.RefreshSession) bool {
-	return session.ExpiresIn.Time().After(time.Now())
+// findSession finds session by indexed selector, so token is compared with exactly one hash.
+// Legacy token without selector is compared with user's legacy sessions
+func (service *RefreshSessionService) findSession(ctx context.Context, GUID string, selector string, verifier string) (*model.RefreshSession, error) {
+	if selector != "" {
+		return service.findSessionBySelector(ctx, selector, verifier)
+	}
+
+	return service.findLegacySession(ctx, GUID, verifier)
 }
 
-func (service *RefreshSessionService) getValidSession(sessions []model.RefreshSession, token string) *model.RefreshSession {
-	var validSession model.RefreshSession
-	for _, session := range sessions {
-		ok := service.hasher.CompareHash(session.RefreshToken, token)
+// findSessionBySelector finds session by indexed selector, so token is compared with exactly one hash
+func (service *RefreshSessionService) findSessionBySelector(ctx context.Context, selector string, verifier string) (*model.RefreshSession, error) {
+	const op = "internal.services.refresh_session.findSessionBySelector"
+
+	session, err := service.refreshSessionRepo.FindBySelector(ctx, selector)
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			return nil, ErrWrongCred
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ok, err := service.hasher.CompareHash(ctx, session.RefreshToken, verifier)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if !ok {
+		return nil, ErrWrongCred
+	}
+
+	return session, nil
+}
+
+// isIssuedTo reports whether session is issued to calling client and, unless client is authenticated,
+// together with presented access token. Legacy session is issued to any first-party caller
+func isIssuedTo(session *model.RefreshSession, input ValidateRefreshSessionInput) bool {
+	// legacy sessions were created by first-party sign-in before clients and access token binding
+	if session.Selector == "" {
+		return session.ClientID == "" && !input.ClientAuthenticated
+	}
+
+	if session.ClientID != input.ClientID {
+		return false
+	}
+
+	// refresh token may be used only with access token it was issued with
+	return input.ClientAuthenticated || (session.AccessTokenID != "" && session.AccessTokenID == input.AccessTokenID)
+}
+
+// findLegacySession looks for session of "guid-hex" token among user's sessions without selector.
+// Such tokens aren't issued anymore, so every user has at most maxSessionCount of them until they expire
+func (service *RefreshSessionService) findLegacySession(ctx context.Context, GUID string, token string) (*model.RefreshSession, error) {
+	const op = "internal.services.refresh_session.findLegacySession"
+
+	if GUID == "" {
+		return nil, ErrWrongCred
+	}
+
+	sessions, err := service.refreshSessionRepo.FindLegacyUserSessions(ctx, GUID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	for i := range sessions {
+		ok, err := service.hasher.CompareHash(ctx, sessions[i].RefreshToken, token)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
 		if ok {
-			validSession = session
+			return &sessions[i], nil
 		}
 	}
 
-	return &validSession
+	return nil, ErrWrongCred
+}
+
+func (service *RefreshSessionService) isSessionNotExpired(session *model.RefreshSession) bool {
+	return session.ExpiresIn.Time().After(time.Now())
+}
+
+// familyOf returns family of session. Sessions created before families were introduced start family with their id
+func familyOf(session *model.RefreshSession) string {
+	return session.Family()
 }
@@ -0,0 +1,408 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidateRefreshSessionRedeemsTokenOnce(t *testing.T) {
+	const requests = 16
+
+	sessions := newMemorySessionRepository()
+	events := &memorySecurityEventRepository{}
+	users := memoryUserRepository{"user": {GUID: "user"}}
+
+	// every request waits in hash comparison until all of them have found the session,
+	// so all of them pass validation before any tries to rotate it
+	var validated sync.WaitGroup
+	validated.Add(requests)
+	service := NewRefreshSessionService(sessions, events, users, barrierHasher{&validated}, 5, 0)
+
+	now := time.Now()
+	_ = sessions.Insert(context.Background(), model.RefreshSession{
+		GUID:          "user",
+		FamilyID:      "family",
+		Selector:      "selector",
+		RefreshToken:  "verifier",
+		AccessTokenID: "access",
+		CreatedAt:     primitive.NewDateTimeFromTime(now),
+		LastUsedAt:    primitive.NewDateTimeFromTime(now),
+		ExpiresIn:     primitive.NewDateTimeFromTime(now.Add(time.Hour)),
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := service.ValidateRefreshSession(context.Background(), ValidateRefreshSessionInput{
+				GUID:          "user",
+				AccessTokenID: "access",
+				Selector:      "selector",
+				Verifier:      "verifier",
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	redeemed := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			redeemed++
+		// session may be already revoked by other request which detected reuse
+		case errors.Is(err, ErrTokenReused), errors.Is(err, ErrWrongCred):
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	if redeemed != 1 {
+		t.Fatalf("token redeemed %d times, want 1", redeemed)
+	}
+	if events.count() == 0 {
+		t.Error("concurrent redemption isn't recorded as reuse")
+	}
+	if _, err := sessions.FindActiveByFamily(context.Background(), "family"); !errors.Is(err, repository.ErrSessionNotFound) {
+		t.Error("family isn't revoked after concurrent redemption")
+	}
+}
+
+func TestValidateRefreshSessionAcceptsLegacyToken(t *testing.T) {
+	sessions := newMemorySessionRepository()
+	events := &memorySecurityEventRepository{}
+	users := memoryUserRepository{"user": {GUID: "user"}}
+	service := NewRefreshSessionService(sessions, events, users, plainHasher{}, 5, 0)
+
+	now := time.Now()
+	for _, token := range []string{"user-0102", "user-0304"} {
+		_ = sessions.Insert(context.Background(), model.RefreshSession{
+			GUID:         "user",
+			RefreshToken: token,
+			ExpiresIn:    primitive.NewDateTimeFromTime(now.Add(time.Hour)),
+		})
+	}
+
+	input := ValidateRefreshSessionInput{GUID: "user", Verifier: "user-0304"}
+	session, err := service.ValidateRefreshSession(context.Background(), input)
+	if err != nil {
+		t.Fatalf("legacy token is rejected: %v", err)
+	}
+	if session.RefreshToken != "user-0304" {
+		t.Fatalf("found session of other token")
+	}
+
+	if _, err := service.ValidateRefreshSession(context.Background(), input); !errors.Is(err, ErrTokenReused) {
+		t.Fatalf("second use of legacy token returned %v, want ErrTokenReused", err)
+	}
+
+	input = ValidateRefreshSessionInput{GUID: "other", Verifier: "user-0102"}
+	if _, err := service.ValidateRefreshSession(context.Background(), input); !errors.Is(err, ErrWrongCred) {
+		t.Fatalf("legacy token of other user returned %v, want ErrWrongCred", err)
+	}
+}
+
+func TestCreateRefreshSessionLimitsConcurrentSignIns(t *testing.T) {
+	const (
+		requests        = 16
+		maxSessionCount = 3
+	)
+
+	sessions := newMemorySessionRepository()
+	users := memoryUserRepository{"user": {GUID: "user"}}
+	service := NewRefreshSessionService(sessions, &memorySecurityEventRepository{}, users, plainHasher{}, maxSessionCount, 0)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			<-start
+			err := service.CreateRefreshSession(context.Background(), CreateRefreshSessionInput{
+				GUID:     "user",
+				Selector: primitive.NewObjectID().Hex(),
+				TTL:      time.Hour,
+			})
+			if err != nil {
+				t.Errorf("can't create session: %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	_, total, err := sessions.FindActiveUserSessions(context.Background(), "user", 0, requests)
+	if err != nil {
+		t.Fatalf("can't count sessions: %v", err)
+	}
+	if total != maxSessionCount {
+		t.Fatalf("user has %d active sessions, want %d", total, maxSessionCount)
+	}
+}
+
+// barrierHasher compares plain strings. CompareHash returns only after it's called by every party of barrier
+type barrierHasher struct {
+	barrier *sync.WaitGroup
+}
+
+func (h barrierHasher) Hash(_ context.Context, input string) (string, error) {
+	return input, nil
+}
+
+func (h barrierHasher) CompareHash(_ context.Context, hash string, input string) (bool, error) {
+	h.barrier.Done()
+	h.barrier.Wait()
+
+	return hash == input, nil
+}
+
+func (h barrierHasher) NeedsRehash(string) bool {
+	return false
+}
+
+// plainHasher compares plain strings
+type plainHasher struct{}
+
+func (plainHasher) Hash(_ context.Context, input string) (string, error) {
+	return input, nil
+}
+
+func (plainHasher) CompareHash(_ context.Context, hash string, input string) (bool, error) {
+	return hash == input, nil
+}
+
+func (plainHasher) NeedsRehash(string) bool {
+	return false
+}
+
+type memoryUserRepository map[string]model.User
+
+func (repo memoryUserRepository) FindByGUID(_ context.Context, guid string) (*model.User, error) {
+	user, ok := repo[guid]
+	if !ok {
+		return nil, repository.ErrUserNotFound
+	}
+
+	return &user, nil
+}
+
+type memorySecurityEventRepository struct {
+	mu     sync.Mutex
+	events []model.SecurityEvent
+}
+
+func (repo *memorySecurityEventRepository) Insert(_ context.Context, event model.SecurityEvent) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.events = append(repo.events, event)
+
+	return nil
+}
+
+func (repo *memorySecurityEventRepository) count() int {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return len(repo.events)
+}
+
+// memorySessionRepository keeps sessions in memory. Every method is atomic like single document operation of mongo
+type memorySessionRepository struct {
+	mu       sync.Mutex
+	sessions map[primitive.ObjectID]model.RefreshSession
+}
+
+func newMemorySessionRepository() *memorySessionRepository {
+	return &memorySessionRepository{sessions: make(map[primitive.ObjectID]model.RefreshSession)}
+}
+
+func (repo *memorySessionRepository) Insert(_ context.Context, session model.RefreshSession) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if session.ID.IsZero() {
+		session.ID = primitive.NewObjectID()
+	}
+	repo.sessions[session.ID] = session
+
+	return nil
+}
+
+func (repo *memorySessionRepository) DeleteByToken(_ context.Context, token string) error {
+	return repo.deleteWhere(func(s model.RefreshSession) bool { return s.RefreshToken == token }, true)
+}
+
+func (repo *memorySessionRepository) DeleteByID(_ context.Context, id primitive.ObjectID) error {
+	return repo.deleteWhere(func(s model.RefreshSession) bool { return s.ID == id }, true)
+}
+
+func (repo *memorySessionRepository) DeleteByFamily(_ context.Context, familyID string) error {
+	return repo.deleteWhere(func(s model.RefreshSession) bool { return s.FamilyID == familyID }, false)
+}
+
+func (repo *memorySessionRepository) DeleteAllUserSessions(_ context.Context, GUID string) error {
+	return repo.deleteWhere(func(s model.RefreshSession) bool { return s.GUID == GUID }, false)
+}
+
+func (repo *memorySessionRepository) DeleteAllUserSessionsExcept(_ context.Context, GUID string, id primitive.ObjectID, familyID string) error {
+	return repo.deleteWhere(func(s model.RefreshSession) bool {
+		return s.GUID == GUID && s.ID != id && s.FamilyID != familyID
+	}, false)
+}
+
+func (repo *memorySessionRepository) MarkRotated(_ context.Context, id primitive.ObjectID) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	session, ok := repo.sessions[id]
+	if !ok || session.IsRotated() {
+		return repository.ErrSessionNotFound
+	}
+	session.RotatedAt = primitive.NewDateTimeFromTime(time.Now())
+	repo.sessions[id] = session
+
+	return nil
+}
+
+func (repo *memorySessionRepository) SetSuccessor(_ context.Context, id primitive.ObjectID, successor []byte, expiresAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	session, ok := repo.sessions[id]
+	if !ok {
+		return repository.ErrSessionNotFound
+	}
+	session.Successor = successor
+	session.SuccessorExpiresAt = primitive.NewDateTimeFromTime(expiresAt)
+	repo.sessions[id] = session
+
+	return nil
+}
+
+func (repo *memorySessionRepository) UnsetExpiredSuccessors(_ context.Context, familyID string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for id, session := range repo.sessions {
+		if session.FamilyID == familyID && session.Successor != nil && !session.HasSuccessor() {
+			session.Successor = nil
+			session.SuccessorExpiresAt = 0
+			repo.sessions[id] = session
+		}
+	}
+
+	return nil
+}
+
+func (repo *memorySessionRepository) DeleteExcessUserSessions(_ context.Context, GUID string, id primitive.ObjectID, keep int64) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var active []model.RefreshSession
+	for _, session := range repo.sessions {
+		if session.GUID == GUID && session.ID != id && isActiveSession(session) {
+			active = append(active, session)
+		}
+	}
+	for int64(len(active)) > max(keep-1, 0) {
+		oldest := 0
+		for i := range active {
+			if active[i].LastUsedAt < active[oldest].LastUsedAt {
+				oldest = i
+			}
+		}
+		delete(repo.sessions, active[oldest].ID)
+		active = append(active[:oldest], active[oldest+1:]...)
+	}
+
+	return nil
+}
+
+func (repo *memorySessionRepository) FindActiveUserSessions(_ context.Context, GUID string, offset int64, limit int64) ([]model.RefreshSession, int64, error) {
+	sessions := repo.findWhere(func(s model.RefreshSession) bool { return s.GUID == GUID && isActiveSession(s) })
+	total := int64(len(sessions))
+
+	sessions = sessions[min(offset, total):min(offset+limit, total)]
+
+	return sessions, total, nil
+}
+
+func (repo *memorySessionRepository) FindBySelector(_ context.Context, selector string) (*model.RefreshSession, error) {
+	return repo.findOne(func(s model.RefreshSession) bool { return s.Selector == selector })
+}
+
+func (repo *memorySessionRepository) FindLegacyUserSessions(_ context.Context, GUID string) ([]model.RefreshSession, error) {
+	return repo.findWhere(func(s model.RefreshSession) bool {
+		return s.GUID == GUID && s.Selector == "" && s.ExpiresIn.Time().After(time.Now())
+	}), nil
+}
+
+func (repo *memorySessionRepository) FindByID(_ context.Context, id primitive.ObjectID) (*model.RefreshSession, error) {
+	return repo.findOne(func(s model.RefreshSession) bool { return s.ID == id })
+}
+
+func (repo *memorySessionRepository) FindActiveByFamily(_ context.Context, familyID string) (*model.RefreshSession, error) {
+	return repo.findOne(func(s model.RefreshSession) bool { return s.FamilyID == familyID && isActiveSession(s) })
+}
+
+func (repo *memorySessionRepository) findWhere(match func(model.RefreshSession) bool) []model.RefreshSession {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var sessions []model.RefreshSession
+	for _, session := range repo.sessions {
+		if match(session) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sessions
+}
+
+func (repo *memorySessionRepository) findOne(match func(model.RefreshSession) bool) (*model.RefreshSession, error) {
+	sessions := repo.findWhere(match)
+	if len(sessions) == 0 {
+		return nil, repository.ErrSessionNotFound
+	}
+
+	return &sessions[0], nil
+}
+
+func (repo *memorySessionRepository) deleteWhere(match func(model.RefreshSession) bool, one bool) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	deleted := false
+	for id, session := range repo.sessions {
+		if match(session) {
+			delete(repo.sessions, id)
+			deleted = true
+			if one {
+				break
+			}
+		}
+	}
+	if one && !deleted {
+		return repository.ErrSessionNotFound
+	}
+
+	return nil
+}
+
+func isActiveSession(session model.RefreshSession) bool {
+	return !session.IsRotated() && session.ExpiresIn.Time().After(time.Now())
+}
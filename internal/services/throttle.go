@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrTooManyAttempts = errors.New("too many failed attempts")
+
+// TooManyAttemptsError is returned when one of attempt keys is locked. It matches ErrTooManyAttempts
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrTooManyAttempts, e.RetryAfter)
+}
+
+func (e *TooManyAttemptsError) Is(target error) bool {
+	return target == ErrTooManyAttempts
+}
+
+// attemptStore keeps failure counters. It must be shared by all instances of the service
+type attemptStore interface {
+	FindByKeys(ctx context.Context, keys []string) ([]model.LoginAttempts, error)
+	AddFailure(ctx context.Context, key string, expiresAt time.Time) (*model.LoginAttempts, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, keys []string) error
+}
+
+// ThrottleService counts failed attempts per key and locks key with exponential backoff:
+// after threshold failures key is locked for baseDelay, every next failure doubles the lock up to maxDelay.
+// Counter is forgotten after window without failures
+type ThrottleService struct {
+	store attemptStore
+
+	threshold int64
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	window    time.Duration
+}
+
+func NewThrottleService(
+	store attemptStore,
+	threshold int64,
+	baseDelay time.Duration,
+	maxDelay time.Duration,
+	window time.Duration,
+) *ThrottleService {
+	return &ThrottleService{
+		store:     store,
+		threshold: threshold,
+		baseDelay: baseDelay,
+		maxDelay:  maxDelay,
+		window:    window,
+	}
+}
+
+// Check returns *TooManyAttemptsError if any of keys is locked. RetryAfter is the longest remaining lock
+func (service *ThrottleService) Check(ctx context.Context, keys ...string) error {
+	const op = "internal.services.throttle.Check"
+
+	attempts, err := service.store.FindByKeys(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+
+	var retryAfter time.Duration
+	for i := range attempts {
+		if attempts[i].IsLocked(now) {
+			retryAfter = max(retryAfter, attempts[i].LockedUntil.Time().Sub(now.Time()))
+		}
+	}
+	if retryAfter > 0 {
+		return &TooManyAttemptsError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// Failure registers failed attempt for every key and locks keys which reached threshold
+func (service *ThrottleService) Failure(ctx context.Context, keys ...string) error {
+	const op = "internal.services.throttle.Failure"
+
+	now := time.Now()
+	for _, key := range keys {
+		attempts, err := service.store.AddFailure(ctx, key, now.Add(service.window))
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		delay := service.lockDelay(attempts.Failures)
+		if delay == 0 {
+			continue
+		}
+
+		err = service.store.Lock(ctx, key, now.Add(delay))
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return nil
+}
+
+// Success resets counters of keys after successful attempt
+func (service *ThrottleService) Success(ctx context.Context, keys ...string) error {
+	const op = "internal.services.throttle.Success"
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err := service.store.Reset(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (service *ThrottleService) lockDelay(failures int64) time.Duration {
+	if failures < service.threshold {
+		return 0
+	}
+
+	delay := service.baseDelay
+	for i := service.threshold; i < failures && delay < service.maxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, service.maxDelay)
+}
+
+// Attempt keys. Counter of IP isn't reset on success, otherwise one valid account would let to brute-force others
+const (
+	throttleKeyIP       = "ip:"
+	throttleKeyUser     = "user:"
+	throttleKeyLogin    = "login:"
+	throttleKeySelector = "selector:"
+)
+
+// appendThrottleKey appends attempt key of value to keys. Empty value doesn't get key
+func appendThrottleKey(keys []string, kind string, value string) []string {
+	if value == "" {
+		return keys
+	}
+
+	return append(keys, kind+value)
+}
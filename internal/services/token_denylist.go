@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type revokedTokenRepository interface {
+	Insert(ctx context.Context, token model.RevokedToken) error
+	Exists(ctx context.Context, jti string) (bool, error)
+}
+
+// TokenDenylistService keeps ids of revoked access tokens until the tokens expire
+type TokenDenylistService struct {
+	revokedTokenRepo revokedTokenRepository
+}
+
+func NewTokenDenylistService(
+	revokedTokenRepo revokedTokenRepository,
+) *TokenDenylistService {
+	return &TokenDenylistService{
+		revokedTokenRepo: revokedTokenRepo,
+	}
+}
+
+// Revoke adds access token with jti to denylist. Token expired by expiresAt doesn't need to be denylisted
+func (service *TokenDenylistService) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	const op = "internal.services.token_denylist.Revoke"
+
+	now := time.Now()
+	if !expiresAt.After(now) {
+		return nil
+	}
+
+	err := service.revokedTokenRepo.Insert(ctx, model.RevokedToken{
+		JTI:       jti,
+		RevokedAt: primitive.NewDateTimeFromTime(now),
+		ExpiresAt: primitive.NewDateTimeFromTime(expiresAt),
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (service *TokenDenylistService) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	const op = "internal.services.token_denylist.IsRevoked"
+
+	revoked, err := service.revokedTokenRepo.Exists(ctx, jti)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return revoked, nil
+}
@@ -0,0 +1,360 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/4aykovksi/medods_test_task/internal/model"
+	"github.com/4aykovksi/medods_test_task/internal/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	minPasswordLength = 8
+	// maxUserUpdateAttempts limits retries of update conflicting with concurrent one
+	maxUserUpdateAttempts = 3
+)
+
+var (
+	ErrInvalidCursor        = errors.New("invalid cursor")
+	ErrPasswordTooShort     = errors.New("password is too short")
+	ErrLoginWithoutPassword = errors.New("login and password must be set together")
+	ErrInvalidUserStatus    = errors.New("invalid user status")
+	ErrUserDisabled         = errors.New("user is disabled")
+	ErrUserLocked           = errors.New("user is locked")
+	ErrUserPending          = errors.New("user isn't activated")
+)
+
+type userManagementRepository interface {
+	FindByGUID(ctx context.Context, guid string) (*model.User, error)
+	Insert(ctx context.Context, user model.User) error
+	List(ctx context.Context, filter repository.UserFilter, after primitive.ObjectID, limit int64) ([]model.User, error)
+	Update(ctx context.Context, GUID string, update repository.UserUpdate) (*model.User, error)
+	Delete(ctx context.Context, GUID string) error
+}
+
+type userSessionRevoker interface {
+	DeleteAllUserSessions(ctx context.Context, GUID string) error
+}
+
+type UserService struct {
+	userRepo       userManagementRepository
+	sessionService userSessionRevoker
+
+	hasher hasher
+}
+
+func NewUserService(
+	userRepo userManagementRepository,
+	sessionService userSessionRevoker,
+	hasher hasher,
+) *UserService {
+	return &UserService{
+		userRepo:       userRepo,
+		sessionService: sessionService,
+		hasher:         hasher,
+	}
+}
+
+// GetUser returns user by GUID. repository.ErrUserNotFound is returned if user doesn't exist
+func (service *UserService) GetUser(ctx context.Context, GUID string) (*model.User, error) {
+	const op = "internal.services.user.GetUser"
+
+	user, err := service.userRepo.FindByGUID(ctx, GUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return nil, repository.ErrUserNotFound
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, nil
+}
+
+type CreateUserInput struct {
+	Login       string
+	Password    string
+	Email       string
+	Roles       []string
+	Permissions []string
+	// Status is optional, user is active by default
+	Status string
+}
+
+// CreateUser creates user with generated GUID. Login is optional, but user with login must have password
+func (service *UserService) CreateUser(ctx context.Context, input CreateUserInput) (*model.User, error) {
+	const op = "internal.services.user.CreateUser"
+
+	if (input.Login == "") != (input.Password == "") {
+		return nil, ErrLoginWithoutPassword
+	}
+
+	status := input.Status
+	if status == "" {
+		status = model.UserStatusActive
+	}
+	if !model.IsUserStatus(status) {
+		return nil, ErrInvalidUserStatus
+	}
+
+	GUID, err := newGUID()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	user := model.User{
+		GUID:        GUID,
+		Login:       input.Login,
+		Email:       input.Email,
+		Roles:       input.Roles,
+		Permissions: input.Permissions,
+		Status:      status,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if input.Password != "" {
+		user.PasswordHash, err = service.hashPassword(ctx, input.Password)
+		if err != nil {
+			if errors.Is(err, ErrPasswordTooShort) {
+				return nil, ErrPasswordTooShort
+			}
+
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	err = service.userRepo.Insert(ctx, user)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserAlreadyExists) {
+			return nil, repository.ErrUserAlreadyExists
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &user, nil
+}
+
+// ListUsers returns page of users matching filter and cursor of the next page.
+// Cursor is empty for the first page, next cursor is empty if there are no more users
+func (service *UserService) ListUsers(ctx context.Context, filter repository.UserFilter, cursor string, limit int64) ([]model.User, string, error) {
+	const op = "internal.services.user.ListUsers"
+
+	var after primitive.ObjectID
+	if cursor != "" {
+		var err error
+		after, err = primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+
+	// one extra user is requested to know whether there is the next page
+	users, err := service.userRepo.List(ctx, filter, after, limit+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	var next string
+	if int64(len(users)) > limit {
+		users = users[:limit]
+		next = users[len(users)-1].ID.Hex()
+	}
+
+	return users, next, nil
+}
+
+// UpdateUserInput describes fields to update, nil fields are kept
+type UpdateUserInput struct {
+	Login       *string
+	Password    *string
+	Email       *string
+	Roles       *[]string
+	Permissions *[]string
+}
+
+// UpdateUser updates user's profile and credentials. Password, roles or permissions change increases user's token
+// version, so all tokens issued before are rejected.
+// Only given fields are written and only if token version wasn't changed since user was read, otherwise update is retried
+func (service *UserService) UpdateUser(ctx context.Context, GUID string, input UpdateUserInput) (*model.User, error) {
+	const op = "internal.services.user.UpdateUser"
+
+	var passwordHash *string
+	for attempt := 0; attempt < maxUserUpdateAttempts; attempt++ {
+		user, err := service.GetUser(ctx, GUID)
+		if err != nil {
+			if errors.Is(err, repository.ErrUserNotFound) {
+				return nil, repository.ErrUserNotFound
+			}
+
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		update := repository.UserUpdate{
+			Login:          input.Login,
+			Email:          input.Email,
+			Roles:          input.Roles,
+			Permissions:    input.Permissions,
+			IfTokenVersion: &user.TokenVersion,
+		}
+		login, hasPassword := user.Login, user.PasswordHash != ""
+		if input.Login != nil {
+			login = *input.Login
+		}
+		if input.Roles != nil && !slices.Equal(user.Roles, *input.Roles) {
+			update.IncTokenVersion = true
+		}
+		if input.Permissions != nil && !slices.Equal(user.Permissions, *input.Permissions) {
+			update.IncTokenVersion = true
+		}
+		if input.Password != nil {
+			if passwordHash == nil {
+				hash, err := service.hashPassword(ctx, *input.Password)
+				if err != nil {
+					if errors.Is(err, ErrPasswordTooShort) {
+						return nil, ErrPasswordTooShort
+					}
+
+					return nil, fmt.Errorf("%s: %w", op, err)
+				}
+				passwordHash = &hash
+			}
+			update.PasswordHash = passwordHash
+			update.IncTokenVersion = true
+			hasPassword = true
+		}
+
+		if (login == "") == hasPassword {
+			return nil, ErrLoginWithoutPassword
+		}
+
+		updated, err := service.userRepo.Update(ctx, GUID, update)
+		if err != nil {
+			if errors.Is(err, repository.ErrUserModified) {
+				continue
+			}
+			if errors.Is(err, repository.ErrUserNotFound) || errors.Is(err, repository.ErrUserAlreadyExists) {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		return updated, nil
+	}
+
+	return nil, fmt.Errorf("%s: %w", op, repository.ErrUserModified)
+}
+
+// SetUserStatus changes user's status. All sessions of user who isn't active anymore are revoked
+// and token version is increased, so access tokens are rejected as well.
+// Status and token version are changed atomically, so concurrent update can't restore them
+func (service *UserService) SetUserStatus(ctx context.Context, GUID string, status string) (*model.User, error) {
+	const op = "internal.services.user.SetUserStatus"
+
+	if !model.IsUserStatus(status) {
+		return nil, ErrInvalidUserStatus
+	}
+
+	user, err := service.userRepo.Update(ctx, GUID, repository.UserUpdate{
+		Status:          &status,
+		IncTokenVersion: status != model.UserStatusActive,
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return nil, repository.ErrUserNotFound
+		}
+
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if !user.IsActive() {
+		err = service.sessionService.DeleteAllUserSessions(ctx, user.GUID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return user, nil
+}
+
+// DeleteUser deletes user and revokes all their sessions
+func (service *UserService) DeleteUser(ctx context.Context, GUID string) error {
+	const op = "internal.services.user.DeleteUser"
+
+	err := service.userRepo.Delete(ctx, GUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return repository.ErrUserNotFound
+		}
+
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = service.sessionService.DeleteAllUserSessions(ctx, GUID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// IsTokenVersionCurrent reports whether token issued with version isn't stale, i.e. user exists and
+// user's token version wasn't increased since
+func (service *UserService) IsTokenVersionCurrent(ctx context.Context, GUID string, version int64) (bool, error) {
+	const op = "internal.services.user.IsTokenVersionCurrent"
+
+	user, err := service.userRepo.FindByGUID(ctx, GUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return version >= user.TokenVersion, nil
+}
+
+// checkUserStatus returns error describing why user can't get tokens or nil if user is active
+func checkUserStatus(user *model.User) error {
+	switch user.Status {
+	case "", model.UserStatusActive:
+		return nil
+	case model.UserStatusLocked:
+		return ErrUserLocked
+	case model.UserStatusPending:
+		return ErrUserPending
+	default:
+		return ErrUserDisabled
+	}
+}
+
+func (service *UserService) hashPassword(ctx context.Context, password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", ErrPasswordTooShort
+	}
+
+	return service.hasher.Hash(ctx, password)
+}
+
+// newGUID generates random RFC 4122 version 4 UUID
+func newGUID() (string, error) {
+	const op = "internal.services.user.newGUID"
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
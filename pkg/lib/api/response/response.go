@@ -8,6 +8,8 @@ const (
 type Response struct {
 	Status string `json:"status"`
 	Error  string `json:"error,omitempty"`
+	// Code is machine-readable reason of error, it's set only for errors client may handle specially
+	Code string `json:"code,omitempty"`
 }
 
 func OK() Response {
@@ -22,3 +24,11 @@ func Error(msg string) Response {
 		Error:  msg,
 	}
 }
+
+func ErrorWithCode(msg string, code string) Response {
+	return Response{
+		Status: StatusError,
+		Error:  msg,
+		Code:   code,
+	}
+}
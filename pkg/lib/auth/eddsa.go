@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"errors"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var ErrEdDSAVerification = errors.New("ed25519: verification error")
+
+// SigningMethodEdDSA implements the EdDSA (Ed25519) signing method,
+// which isn't shipped with jwt-go v3.
+// Expects ed25519.PrivateKey for signing and ed25519.PublicKey for verification
+type SigningMethodEdDSA struct{}
+
+var SigningMethodEd25519 *SigningMethodEdDSA
+
+func init() {
+	SigningMethodEd25519 = &SigningMethodEdDSA{}
+	jwt.RegisterSigningMethod(SigningMethodEd25519.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEd25519
+	})
+}
+
+func (m *SigningMethodEdDSA) Alg() string {
+	return AlgEdDSA
+}
+
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	if len(publicKey) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKey
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return ErrEdDSAVerification
+	}
+
+	return nil
+}
+
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKey
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// OpenID Connect scopes. id_token is issued only if ScopeOpenID is granted, email claim requires ScopeEmail.
+// ScopeRoles allows to get user's roles from userinfo
+const (
+	ScopeOpenID = "openid"
+	ScopeEmail  = "email"
+	ScopeRoles  = "roles"
+)
+
+// IDTokenClaims are claims of OpenID Connect id_token. Audience is id of client the token is issued to
+type IDTokenClaims struct {
+	jwt.StandardClaims
+	Nonce    string `json:"nonce,omitempty"`
+	AuthTime int64  `json:"auth_time,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// Issuer returns iss claim of issued tokens
+func (m *Manager) Issuer() string {
+	return m.issuer
+}
+
+// SigningAlgorithms returns algorithms of keys tokens can be signed with
+func (m *Manager) SigningAlgorithms() []string {
+	var algorithms []string
+	for _, key := range m.keys.JWKS().Keys {
+		if !slices.Contains(algorithms, key.Algorithm) {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+
+	return algorithms
+}
+
+// newIDToken creates id_token for client tokens are issued to. It lives as long as access token
+func (m *Manager) newIDToken(params TokenParams) (string, error) {
+	const op = "pkg.lib.auth.id_token.newIDToken"
+
+	key, err := m.keys.SigningKey()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	claims := IDTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    m.issuer,
+			Audience:  params.ClientID,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(params.AccessTokenTTL).Unix(),
+			Subject:   params.Subject,
+		},
+		Nonce: params.Nonce,
+	}
+	if !params.AuthTime.IsZero() {
+		claims.AuthTime = params.AuthTime.Unix()
+	}
+	if slices.Contains(params.Scopes, ScopeEmail) {
+		claims.Email = params.Email
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.ID
+
+	completeToken, err := token.SignedString(key.private)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return completeToken, nil
+}
@@ -0,0 +1,387 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+
+	minRSAKeyBits = 2048
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrUnsupportedKey       = errors.New("unsupported private key type")
+	ErrKeyNotFound          = errors.New("key not found in keyset")
+	ErrKeyAlreadyExists     = errors.New("key with the same id already exists in keyset")
+	ErrKeyRetired           = errors.New("key is retired")
+	ErrKeyExpired           = errors.New("retired key is expired")
+	ErrSigningKeyInUse      = errors.New("key is used for signing")
+)
+
+// Key is an asymmetric private key used to sign access tokens
+type Key struct {
+	ID        string
+	Algorithm string
+
+	private crypto.Signer
+	method  jwt.SigningMethod
+}
+
+// NewKey wraps private key. Algorithm is chosen by key type: RSA - RS256, P-256 - ES256, Ed25519 - EdDSA.
+// If kid is empty, RFC 7638 thumbprint of the public key is used
+func NewKey(kid string, private crypto.Signer) (*Key, error) {
+	const op = "pkg.lib.auth.keyset.NewKey"
+
+	key := &Key{ID: kid, private: private}
+
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("%s: rsa key must be at least %d bits", op, minRSAKeyBits)
+		}
+		key.Algorithm, key.method = AlgRS256, jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: %w: only P-256 curve is supported", op, ErrUnsupportedKey)
+		}
+		key.Algorithm, key.method = AlgES256, jwt.SigningMethodES256
+	case ed25519.PrivateKey:
+		key.Algorithm, key.method = AlgEdDSA, SigningMethodEd25519
+	default:
+		return nil, fmt.Errorf("%s: %w", op, ErrUnsupportedKey)
+	}
+
+	if key.ID == "" {
+		key.ID = key.thumbprint()
+	}
+
+	return key, nil
+}
+
+// GenerateKey generates new private key for given algorithm
+func GenerateKey(alg string) (*Key, error) {
+	const op = "pkg.lib.auth.keyset.GenerateKey"
+
+	var (
+		private crypto.Signer
+		err     error
+	)
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("%s: %w: %s", op, ErrUnsupportedAlgorithm, alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	key, err := NewKey("", private)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+// ParseKeyPEM parses PKCS #8, PKCS #1 or SEC 1 PEM encoded private key
+func ParseKeyPEM(kid string, data []byte) (*Key, error) {
+	const op = "pkg.lib.auth.keyset.ParseKeyPEM"
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: can't decode pem block", op)
+	}
+
+	var (
+		private any
+		err     error
+	)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, ErrUnsupportedKey)
+	}
+
+	key, err := NewKey(kid, signer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+func (k *Key) Public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// JWK returns public part of the key in RFC 7517 format
+func (k *Key) JWK() JWK {
+	jwk := JWK{
+		KeyID:     k.ID,
+		Use:       "sig",
+		Algorithm: k.Algorithm,
+	}
+
+	switch pub := k.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encodeBase64URL(pub.N.Bytes())
+		jwk.E = encodeBase64URL(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = pub.Curve.Params().Name
+		jwk.X = encodeBase64URL(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = encodeBase64URL(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encodeBase64URL(pub)
+	}
+
+	return jwk
+}
+
+// thumbprint computes RFC 7638 JWK thumbprint
+func (k *Key) thumbprint() string {
+	jwk := k.JWK()
+
+	var canonical string
+	switch jwk.KeyType {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Curve, jwk.X, jwk.Y)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, jwk.Curve, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return encodeBase64URL(sum[:])
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type keySetEntry struct {
+	key     *Key
+	retired bool
+	// retiredUntil is time retired key is verified and published until
+	retiredUntil time.Time
+}
+
+// isExpired reports whether retired key mustn't be used anymore
+func (e *keySetEntry) isExpired(now time.Time) bool {
+	return e.retired && !now.Before(e.retiredUntil)
+}
+
+// KeySet holds the key currently used for signing and keys which are only used for verification.
+// Active keys are published before they start signing, so verifiers know them in advance, and can become signing ones.
+// Retired keys can't sign anymore, they are verified and published only until their deadline,
+// which must outlive every token signed with them, so rotation doesn't invalidate issued tokens
+type KeySet struct {
+	mu        sync.RWMutex
+	entries   []*keySetEntry
+	signingID string
+}
+
+func NewKeySet(signingKey *Key, verificationKeys ...*Key) (*KeySet, error) {
+	const op = "pkg.lib.auth.keyset.NewKeySet"
+
+	ks := &KeySet{}
+
+	err := ks.Rotate(signingKey, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	for _, key := range verificationKeys {
+		err = ks.Add(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return ks, nil
+}
+
+// Add publishes key for verification without signing with it
+func (ks *KeySet) Add(key *Key) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.find(key.ID) != nil {
+		return ErrKeyAlreadyExists
+	}
+
+	ks.entries = append(ks.entries, &keySetEntry{key: key})
+
+	return nil
+}
+
+// Rotate makes key the signing one, adding it to keyset if needed. Previous signing key is retired until retiredUntil
+func (ks *KeySet) Rotate(key *Key, retiredUntil time.Time) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	entry := ks.find(key.ID)
+	if entry == nil {
+		entry = &keySetEntry{key: key}
+		ks.entries = append(ks.entries, entry)
+	}
+	if entry.retired {
+		return ErrKeyRetired
+	}
+
+	if previous := ks.find(ks.signingID); previous != nil && previous != entry {
+		previous.retired, previous.retiredUntil = true, retiredUntil
+	}
+	ks.signingID = entry.key.ID
+
+	return nil
+}
+
+// Retire marks key as retired. Retired key can't become signing one and is used for verification only until retiredUntil
+func (ks *KeySet) Retire(kid string, retiredUntil time.Time) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if kid == ks.signingID {
+		return ErrSigningKeyInUse
+	}
+
+	entry := ks.find(kid)
+	if entry == nil {
+		return ErrKeyNotFound
+	}
+	entry.retired, entry.retiredUntil = true, retiredUntil
+
+	return nil
+}
+
+// Remove deletes key from keyset. Tokens signed with removed key can't be verified anymore
+func (ks *KeySet) Remove(kid string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if kid == ks.signingID {
+		return ErrSigningKeyInUse
+	}
+
+	for i, entry := range ks.entries {
+		if entry.key.ID == kid {
+			ks.entries = append(ks.entries[:i], ks.entries[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrKeyNotFound
+}
+
+func (ks *KeySet) SigningKey() (*Key, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	entry := ks.find(ks.signingID)
+	if entry == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return entry.key, nil
+}
+
+// VerificationKey returns active key or retired key which hasn't expired with given kid
+func (ks *KeySet) VerificationKey(kid string) (*Key, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	entry := ks.find(kid)
+	if entry == nil {
+		return nil, ErrKeyNotFound
+	}
+	if entry.isExpired(time.Now()) {
+		return nil, ErrKeyExpired
+	}
+
+	return entry.key, nil
+}
+
+// JWKS returns public parts of all active keys and retired keys which haven't expired
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	jwks := JWKS{Keys: make([]JWK, 0, len(ks.entries))}
+	for _, entry := range ks.entries {
+		if entry.isExpired(now) {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, entry.key.JWK())
+	}
+
+	return jwks
+}
+
+func (ks *KeySet) find(kid string) *keySetEntry {
+	for _, entry := range ks.entries {
+		if entry.key.ID == kid {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+func encodeBase64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
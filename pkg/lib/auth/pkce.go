@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// CodeChallengeMethodS256 is the only supported PKCE method, plain is rejected
+const CodeChallengeMethodS256 = "S256"
+
+const (
+	authorizationCodeSize   = 32
+	minCodeVerifierLength   = 43
+	maxCodeVerifierLength   = 128
+	s256CodeChallengeLength = 43
+)
+
+// CreateAuthorizationCode generates random authorization code for authorization code grant
+func (m *Manager) CreateAuthorizationCode() (string, error) {
+	return randomString(authorizationCodeSize)
+}
+
+// ValidCodeChallenge checks that challenge can be base64url encoded SHA-256 of code verifier
+func ValidCodeChallenge(challenge string, method string) bool {
+	return method == CodeChallengeMethodS256 && len(challenge) == s256CodeChallengeLength && isUnreserved(challenge)
+}
+
+// VerifyCodeChallenge checks code verifier against challenge, RFC 7636 section 4.6
+func VerifyCodeChallenge(verifier string, challenge string, method string) bool {
+	if method != CodeChallengeMethodS256 {
+		return false
+	}
+
+	if len(verifier) < minCodeVerifierLength || len(verifier) > maxCodeVerifierLength || !isUnreserved(verifier) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+
+	return subtle.ConstantTimeCompare([]byte(encodeBase64URL(sum[:])), []byte(challenge)) == 1
+}
+
+// isUnreserved reports whether s consists of characters allowed in code verifier: [A-Z] / [a-z] / [0-9] / "-" / "." / "_" / "~"
+func isUnreserved(s string) bool {
+	for _, c := range s {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
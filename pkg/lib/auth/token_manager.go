@@ -1,74 +1,201 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"math/rand"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
+const (
+	refreshTokenDelimiter = "."
+	refreshSelectorSize   = 12
+	refreshVerifierSize   = 32
+)
+
+var (
+	ErrInvalidIssuer   = errors.New("token has invalid issuer")
+	ErrInvalidAudience = errors.New("token has invalid audience")
+)
+
 type Manager struct {
-	secret string
+	keys     *KeySet
+	issuer   string
+	audience string
 }
 
-func NewManager(secret string) *Manager {
+func NewManager(keys *KeySet, issuer string, audience string) *Manager {
 	return &Manager{
-		secret: secret,
+		keys:     keys,
+		issuer:   issuer,
+		audience: audience,
 	}
 }
 
-func (m *Manager) CreateTokensPair(userId string, accessTokenTtl, refreshTokenTtl time.Duration) (*Tokens, error) {
+func (m *Manager) CreateTokensPair(params TokenParams) (*Tokens, error) {
 	const op = "pkg.lib.auth.token_manager.CreateTokensPair"
 
-	accessToken, err := m.newJWT(userId, accessTokenTtl)
+	tokens, err := m.CreateAccessToken(params)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	selector, verifier, err := m.newRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if params.ClientID != "" && slices.Contains(params.Scopes, ScopeOpenID) {
+		tokens.IDToken, err = m.newIDToken(params)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	tokens.RefreshToken = selector + refreshTokenDelimiter + verifier
+	tokens.RefreshSelector = selector
+	tokens.RefreshVerifier = verifier
+	tokens.ExpiresIn = time.Now().Add(params.RefreshTokenTTL)
+
+	return tokens, nil
+}
+
+// CreateAccessToken creates access token without refresh token, e.g. for client credentials grant
+func (m *Manager) CreateAccessToken(params TokenParams) (*Tokens, error) {
+	const op = "pkg.lib.auth.token_manager.CreateAccessToken"
+
+	accessTokenID, err := newTokenID()
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	refreshToken, err := m.newRefreshToken(userId)
+	accessToken, err := m.newJWT(params, accessTokenID)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return &Tokens{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    time.Now().Add(refreshTokenTtl),
+		AccessToken:          accessToken,
+		AccessTokenID:        accessTokenID,
+		AccessTokenExpiresIn: time.Now().Add(params.AccessTokenTTL),
+		Scopes:               params.Scopes,
 	}, nil
 }
 
-func (m *Manager) Parse(inputToken string) (string, error) {
-	const op = "lib.token-manager.token_manager.Parse"
+// Parse verifies signature, expiration, issuer and audience of access token and returns its claims
+func (m *Manager) Parse(inputToken string) (*Claims, error) {
+	const op = "pkg.lib.auth.token_manager.Parse"
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(inputToken, &claims, m.verificationKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = m.verifyClaims(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &claims, nil
+}
+
+// ParseAllowExpired verifies token signature like Parse, but accepts expired tokens.
+// It's used on refresh, when access token is usually already expired
+func (m *Manager) ParseAllowExpired(inputToken string) (*Claims, error) {
+	const op = "pkg.lib.auth.token_manager.ParseAllowExpired"
 
-	token, err := jwt.Parse(inputToken, func(token *jwt.Token) (i interface{}, err error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	var claims Claims
+	_, err := jwt.ParseWithClaims(inputToken, &claims, m.verificationKey)
+	if err != nil {
+		var validationErr *jwt.ValidationError
+		if !errors.As(err, &validationErr) || validationErr.Errors != jwt.ValidationErrorExpired {
+			return nil, fmt.Errorf("%s: %w", op, err)
 		}
+	}
 
-		return []byte(m.secret), nil
-	})
+	err = m.verifyClaims(&claims)
 	if err != nil {
-		return "", fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
+	return &claims, nil
+}
+
+// verifyClaims checks claims which aren't verified by jwt-go itself
+func (m *Manager) verifyClaims(claims *Claims) error {
+	if claims.Subject == "" {
+		return fmt.Errorf("token doesn't have subject")
+	}
+
+	if !claims.VerifyIssuer(m.issuer, true) {
+		return ErrInvalidIssuer
+	}
+
+	if !claims.VerifyAudience(m.audience, true) {
+		return ErrInvalidAudience
+	}
+
+	return nil
+}
+
+// JWKS returns public keys which can be used to verify issued access tokens
+func (m *Manager) JWKS() JWKS {
+	return m.keys.JWKS()
+}
+
+// verificationKey finds public key by kid header and checks that token is signed with algorithm of that key
+func (m *Manager) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
 	if !ok {
-		return "", fmt.Errorf("%s: can't get user claims from token", op)
+		return nil, fmt.Errorf("token doesn't have kid header")
+	}
+
+	key, err := m.keys.VerificationKey(kid)
+	if err != nil {
+		return nil, err
 	}
 
-	return claims["sub"].(string), nil
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.Public(), nil
 }
 
-func (m *Manager) newJWT(userId string, ttl time.Duration) (string, error) {
+func (m *Manager) newJWT(params TokenParams, tokenID string) (string, error) {
 	const op = "pkg.lib.auth.token_manager.newJWT"
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.StandardClaims{
-		ExpiresAt: time.Now().Add(ttl).Unix(),
-		Subject:   userId,
+	key, err := m.keys.SigningKey()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(key.method, Claims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
+			Issuer:    m.issuer,
+			Audience:  m.audience,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(params.AccessTokenTTL).Unix(),
+			Subject:   params.Subject,
+		},
+		ClientID:     params.ClientID,
+		IP:           params.IP,
+		Roles:        params.Roles,
+		SessionID:    params.SessionID,
+		TokenVersion: params.TokenVersion,
+		Scope:        strings.Join(params.Scopes, " "),
 	})
+	token.Header["kid"] = key.ID
 
-	completeToken, err := token.SignedString([]byte(m.secret))
+	completeToken, err := token.SignedString(key.private)
 	if err != nil {
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
@@ -76,17 +203,52 @@ func (m *Manager) newJWT(userId string, ttl time.Duration) (string, error) {
 	return completeToken, nil
 }
 
-func (m *Manager) newRefreshToken(userId string) (string, error) {
+// newRefreshToken generates opaque refresh token parts: selector, used to find session, and secret verifier
+func (m *Manager) newRefreshToken() (string, string, error) {
 	const op = "pkg.lib.auth.token_manager.newRefreshToken"
 
-	buffer := make([]byte, 7)
+	selector, err := randomString(refreshSelectorSize)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
 
-	seed := rand.NewSource(time.Now().Unix())
-	randGen := rand.New(seed)
+	verifier, err := randomString(refreshVerifierSize)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return selector, verifier, nil
+}
 
-	if _, err := randGen.Read(buffer); err != nil {
+// SplitRefreshToken splits refresh token into selector and verifier.
+// ok is false for tokens which don't have selector/verifier format
+func SplitRefreshToken(token string) (selector string, verifier string, ok bool) {
+	selector, verifier, ok = strings.Cut(token, refreshTokenDelimiter)
+	if !ok || selector == "" || verifier == "" {
+		return "", "", false
+	}
+
+	return selector, verifier, true
+}
+
+// newTokenID generates random jti
+func newTokenID() (string, error) {
+	const op = "pkg.lib.auth.token_manager.newTokenID"
+
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
-	return fmt.Sprintf("%s-%x", userId, buffer), nil
+	return hex.EncodeToString(buffer), nil
+}
+
+// randomString returns size bytes from crypto/rand encoded in base64url
+func randomString(size int) (string, error) {
+	buffer := make([]byte, size)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	return encodeBase64URL(buffer), nil
 }
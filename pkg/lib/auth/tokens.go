@@ -1,9 +1,65 @@
 package auth
 
-import "time"
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
 
 type Tokens struct {
-	AccessToken  string
-	RefreshToken string
-	ExpiresIn    time.Time
+	AccessToken          string
+	AccessTokenID        string
+	AccessTokenExpiresIn time.Time
+	// Scopes are scopes granted to access token
+	Scopes []string
+	// IDToken is OpenID Connect id_token. It's issued only to clients granted openid scope
+	IDToken string
+	// RefreshToken is RefreshSelector and RefreshVerifier joined with delimiter
+	RefreshToken    string
+	RefreshSelector string
+	RefreshVerifier string
+	ExpiresIn       time.Time
+}
+
+// TokenParams describes tokens pair to create
+type TokenParams struct {
+	Subject string
+	// ClientID is id of OAuth client tokens are issued to
+	ClientID        string
+	IP              string
+	Roles           []string
+	Scopes          []string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// SessionID is id of refresh session family, it's put into sid claim
+	SessionID string
+	// TokenVersion is user's token version, it's put into ver claim
+	TokenVersion int64
+	// Nonce, AuthTime and Email are id_token claims
+	Nonce    string
+	AuthTime time.Time
+	Email    string
+}
+
+type Claims struct {
+	jwt.StandardClaims
+	ClientID string   `json:"client_id,omitempty"`
+	IP       string   `json:"ip,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	// SessionID is id of refresh session family token was issued with. Client credentials tokens don't have it
+	SessionID string `json:"sid,omitempty"`
+	// TokenVersion is user's token version at the time token was issued. Token is stale once user's version is increased
+	TokenVersion int64 `json:"ver,omitempty"`
+	// Scope is space-delimited list of scopes as in RFC 8693
+	Scope string `json:"scope,omitempty"`
+}
+
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+func (c *Claims) HasRole(role string) bool {
+	return slices.Contains(c.Roles, role)
 }
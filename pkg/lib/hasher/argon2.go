@@ -0,0 +1,108 @@
+package hasher
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2idID      = "argon2id"
+	argon2SaltSize  = 16
+	argon2KeyLength = 32
+)
+
+// Argon2idHasher hashes with argon2id, RFC 9106. Hash is encoded in PHC format with its parameters,
+// so hashes created with other parameters are still verified
+type Argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// NewArgon2idHasher creates hasher with time (passes), memory in KiB and threads (parallelism) parameters
+func NewArgon2idHasher(time uint32, memory uint32, threads uint8) *Argon2idHasher {
+	return &Argon2idHasher{
+		time:    time,
+		memory:  memory,
+		threads: threads,
+	}
+}
+
+func (a *Argon2idHasher) Hash(input string) (string, error) {
+	const op = "pkg.lib.hasher.argon2.Hash"
+
+	salt, err := newSalt(argon2SaltSize)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	key := argon2.IDKey([]byte(input), salt, a.time, a.memory, a.threads, argon2KeyLength)
+
+	return formatPHC(
+		argon2idID,
+		fmt.Sprintf("v=%d", argon2.Version),
+		fmt.Sprintf("m=%d,t=%d,p=%d", a.memory, a.time, a.threads),
+		salt,
+		key,
+	), nil
+}
+
+func (a *Argon2idHasher) CompareHash(hash string, input string) bool {
+	params, phc, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(input), phc.salt, params.time, params.memory, params.threads, uint32(len(phc.hash)))
+
+	return subtle.ConstantTimeCompare(key, phc.hash) == 1
+}
+
+// NeedsRehash reports whether hash was created with parameters other than configured ones
+func (a *Argon2idHasher) NeedsRehash(hash string) bool {
+	params, phc, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	return *params != *a || len(phc.hash) != argon2KeyLength
+}
+
+func (a *Argon2idHasher) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$"+argon2idID+"$")
+}
+
+func parseArgon2id(hash string) (*Argon2idHasher, *phcHash, error) {
+	const op = "pkg.lib.hasher.argon2.parseArgon2id"
+
+	phc, err := parsePHC(argon2idID, hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	version, err := phc.uintParam("v", 32)
+	if err != nil || version != argon2.Version {
+		return nil, nil, fmt.Errorf("%s: %w", op, errMalformedHash)
+	}
+
+	memory, err := phc.uintParam("m", 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	time, err := phc.uintParam("t", 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	threads, err := phc.uintParam("p", 8)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if time == 0 || threads == 0 || len(phc.hash) == 0 {
+		return nil, nil, fmt.Errorf("%s: %w", op, errMalformedHash)
+	}
+
+	return NewArgon2idHasher(uint32(time), uint32(memory), uint8(threads)), phc, nil
+}
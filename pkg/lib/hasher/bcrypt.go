@@ -2,21 +2,25 @@ package hasher
 
 import (
 	"fmt"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type BcryptHasher struct {
+	cost int
 }
 
-func NewBcryptHasher() *BcryptHasher {
-	return &BcryptHasher{}
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{
+		cost: cost,
+	}
 }
 
 func (b *BcryptHasher) Hash(input string) (string, error) {
 	const op = "pkg.lib.hasher.bcrypt.Hash"
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(input), 12)
+	hash, err := bcrypt.GenerateFromPassword([]byte(input), b.cost)
 	if err != nil {
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
@@ -32,3 +36,18 @@ func (b *BcryptHasher) CompareHash(hash string, input string) bool {
 
 	return true
 }
+
+// NeedsRehash reports whether hash was created with cost other than configured one
+func (b *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+
+	return cost != b.cost
+}
+
+// Identifies reports whether hash is bcrypt hash: $2a$, $2b$ or $2y$
+func (b *BcryptHasher) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
@@ -0,0 +1,89 @@
+package hasher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Names of algorithms MultiHasher can hash with
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmScrypt   = "scrypt"
+)
+
+var ErrUnknownAlgorithm = errors.New("unknown hashing algorithm")
+
+type algorithm interface {
+	Hash(input string) (string, error)
+	CompareHash(hash string, input string) bool
+	NeedsRehash(hash string) bool
+	Identifies(hash string) bool
+}
+
+// MultiHasher hashes with primary algorithm and verifies hashes of any supported algorithm,
+// which is detected by hash prefix. Hash of other algorithm or with outdated parameters needs rehash
+type MultiHasher struct {
+	primary    algorithm
+	algorithms []algorithm
+}
+
+func NewMultiHasher(
+	primary string,
+	bcrypt *BcryptHasher,
+	argon2id *Argon2idHasher,
+	scrypt *ScryptHasher,
+) (*MultiHasher, error) {
+	const op = "pkg.lib.hasher.multi.NewMultiHasher"
+
+	algorithms := map[string]algorithm{
+		AlgorithmBcrypt:   bcrypt,
+		AlgorithmArgon2id: argon2id,
+		AlgorithmScrypt:   scrypt,
+	}
+
+	primaryAlgorithm, ok := algorithms[primary]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w: %s", op, ErrUnknownAlgorithm, primary)
+	}
+
+	return &MultiHasher{
+		primary:    primaryAlgorithm,
+		algorithms: []algorithm{bcrypt, argon2id, scrypt},
+	}, nil
+}
+
+func (m *MultiHasher) Hash(input string) (string, error) {
+	const op = "pkg.lib.hasher.multi.Hash"
+
+	hash, err := m.primary.Hash(input)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return hash, nil
+}
+
+func (m *MultiHasher) CompareHash(hash string, input string) bool {
+	algorithm := m.algorithmOf(hash)
+	if algorithm == nil {
+		return false
+	}
+
+	return algorithm.CompareHash(hash, input)
+}
+
+// NeedsRehash reports whether hash isn't created by primary algorithm with its current parameters
+func (m *MultiHasher) NeedsRehash(hash string) bool {
+	return !m.primary.Identifies(hash) || m.primary.NeedsRehash(hash)
+}
+
+func (m *MultiHasher) algorithmOf(hash string) algorithm {
+	for _, algorithm := range m.algorithms {
+		if algorithm.Identifies(hash) {
+			return algorithm
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errMalformedHash = errors.New("malformed hash")
+
+// phcHash is hash in PHC string format: $id$param=value,...$salt$hash, salt and hash are unpadded base64
+type phcHash struct {
+	id     string
+	params map[string]string
+	salt   []byte
+	hash   []byte
+}
+
+// parsePHC parses hash of algorithm id. Version field, e.g. v=19 of argon2, is put into params
+func parsePHC(id string, encoded string) (*phcHash, error) {
+	const op = "pkg.lib.hasher.phc.parsePHC"
+
+	fields := strings.Split(encoded, "$")
+	// leading empty field, id, optional version, params, salt, hash
+	if len(fields) < 5 || fields[0] != "" || fields[1] != id {
+		return nil, fmt.Errorf("%s: %w", op, errMalformedHash)
+	}
+
+	phc := &phcHash{
+		id:     id,
+		params: make(map[string]string),
+	}
+	for _, field := range fields[2 : len(fields)-2] {
+		for _, param := range strings.Split(field, ",") {
+			name, value, ok := strings.Cut(param, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s: %w", op, errMalformedHash)
+			}
+			phc.params[name] = value
+		}
+	}
+
+	var err error
+	phc.salt, err = base64.RawStdEncoding.DecodeString(fields[len(fields)-2])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	phc.hash, err = base64.RawStdEncoding.DecodeString(fields[len(fields)-1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return phc, nil
+}
+
+func (phc *phcHash) uintParam(name string, bitSize int) (uint64, error) {
+	const op = "pkg.lib.hasher.phc.uintParam"
+
+	value, err := strconv.ParseUint(phc.params[name], 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s: %w", op, name, err)
+	}
+
+	return value, nil
+}
+
+// formatPHC encodes hash, params are written in given order as one field
+func formatPHC(id string, version string, params string, salt []byte, hash []byte) string {
+	var b strings.Builder
+	b.WriteString("$" + id)
+	if version != "" {
+		b.WriteString("$" + version)
+	}
+	b.WriteString("$" + params)
+	b.WriteString("$" + base64.RawStdEncoding.EncodeToString(salt))
+	b.WriteString("$" + base64.RawStdEncoding.EncodeToString(hash))
+
+	return b.String()
+}
+
+func newSalt(size int) ([]byte, error) {
+	const op = "pkg.lib.hasher.phc.newSalt"
+
+	salt := make([]byte, size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return salt, nil
+}
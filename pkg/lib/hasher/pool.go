@@ -0,0 +1,118 @@
+package hasher
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+)
+
+var ErrBusy = errors.New("hasher is busy")
+
+type syncHasher interface {
+	Hash(input string) (string, error)
+	CompareHash(hash string, input string) bool
+	NeedsRehash(hash string) bool
+}
+
+// Pool limits number of concurrent hash operations, so bursts of sign-ins can't take every CPU.
+// At most parallelism operations run at once and up to queueDepth wait for a free slot,
+// the rest are rejected with ErrBusy at once. Waiting operation is abandoned when its context is done,
+// but running one is completed, since hash functions can't be interrupted
+type Pool struct {
+	hasher syncHasher
+
+	slots chan struct{}
+	queue chan struct{}
+
+	metrics *expvar.Map
+}
+
+func NewPool(hasher syncHasher, parallelism int, queueDepth int) *Pool {
+	metrics := new(expvar.Map)
+	for _, name := range []string{"waiting", "running", "completed", "rejected", "canceled", "wait_ns_total"} {
+		metrics.Set(name, new(expvar.Int))
+	}
+
+	return &Pool{
+		hasher:  hasher,
+		slots:   make(chan struct{}, parallelism),
+		queue:   make(chan struct{}, parallelism+queueDepth),
+		metrics: metrics,
+	}
+}
+
+// Metrics returns pool counters: waiting and running operations, completed, rejected and canceled ones
+// and total time completed operations waited in queue, wait_ns_total / completed is mean queue wait
+func (p *Pool) Metrics() expvar.Var {
+	return p.metrics
+}
+
+func (p *Pool) Hash(ctx context.Context, input string) (string, error) {
+	const op = "pkg.lib.hasher.pool.Hash"
+
+	var hash string
+	var hashErr error
+	err := p.run(ctx, func() {
+		hash, hashErr = p.hasher.Hash(input)
+	})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	if hashErr != nil {
+		return "", fmt.Errorf("%s: %w", op, hashErr)
+	}
+
+	return hash, nil
+}
+
+// CompareHash reports whether input matches hash. Error is returned only if comparison wasn't made
+func (p *Pool) CompareHash(ctx context.Context, hash string, input string) (bool, error) {
+	const op = "pkg.lib.hasher.pool.CompareHash"
+
+	var ok bool
+	err := p.run(ctx, func() {
+		ok = p.hasher.CompareHash(hash, input)
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return ok, nil
+}
+
+// NeedsRehash only parses hash, so it isn't limited
+func (p *Pool) NeedsRehash(hash string) bool {
+	return p.hasher.NeedsRehash(hash)
+}
+
+func (p *Pool) run(ctx context.Context, operation func()) error {
+	select {
+	case p.queue <- struct{}{}:
+	default:
+		p.metrics.Add("rejected", 1)
+		return ErrBusy
+	}
+	defer func() { <-p.queue }()
+
+	start := time.Now()
+	p.metrics.Add("waiting", 1)
+	select {
+	case p.slots <- struct{}{}:
+		p.metrics.Add("waiting", -1)
+	case <-ctx.Done():
+		p.metrics.Add("waiting", -1)
+		p.metrics.Add("canceled", 1)
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	p.metrics.Add("wait_ns_total", int64(time.Since(start)))
+	p.metrics.Add("running", 1)
+	operation()
+	p.metrics.Add("running", -1)
+	p.metrics.Add("completed", 1)
+
+	return nil
+}
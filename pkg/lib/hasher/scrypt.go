@@ -0,0 +1,110 @@
+package hasher
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	scryptID        = "scrypt"
+	scryptSaltSize  = 16
+	scryptKeyLength = 32
+)
+
+// ScryptHasher hashes with scrypt, RFC 7914. Hash is encoded in PHC format $scrypt$ln=,r=,p=$salt$hash,
+// where N = 2^ln, so hashes created with other parameters are still verified
+type ScryptHasher struct {
+	costLog2    uint8
+	blockSize   int
+	parallelism int
+}
+
+// NewScryptHasher creates hasher with CPU/memory cost N = 2^costLog2, block size r and parallelism p
+func NewScryptHasher(costLog2 uint8, blockSize int, parallelism int) *ScryptHasher {
+	return &ScryptHasher{
+		costLog2:    costLog2,
+		blockSize:   blockSize,
+		parallelism: parallelism,
+	}
+}
+
+func (s *ScryptHasher) Hash(input string) (string, error) {
+	const op = "pkg.lib.hasher.scrypt.Hash"
+
+	salt, err := newSalt(scryptSaltSize)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	key, err := scrypt.Key([]byte(input), salt, 1<<s.costLog2, s.blockSize, s.parallelism, scryptKeyLength)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return formatPHC(
+		scryptID,
+		"",
+		fmt.Sprintf("ln=%d,r=%d,p=%d", s.costLog2, s.blockSize, s.parallelism),
+		salt,
+		key,
+	), nil
+}
+
+func (s *ScryptHasher) CompareHash(hash string, input string) bool {
+	params, phc, err := parseScrypt(hash)
+	if err != nil {
+		return false
+	}
+
+	key, err := scrypt.Key([]byte(input), phc.salt, 1<<params.costLog2, params.blockSize, params.parallelism, len(phc.hash))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, phc.hash) == 1
+}
+
+// NeedsRehash reports whether hash was created with parameters other than configured ones
+func (s *ScryptHasher) NeedsRehash(hash string) bool {
+	params, phc, err := parseScrypt(hash)
+	if err != nil {
+		return true
+	}
+
+	return *params != *s || len(phc.hash) != scryptKeyLength
+}
+
+func (s *ScryptHasher) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$"+scryptID+"$")
+}
+
+func parseScrypt(hash string) (*ScryptHasher, *phcHash, error) {
+	const op = "pkg.lib.hasher.scrypt.parseScrypt"
+
+	phc, err := parsePHC(scryptID, hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	costLog2, err := phc.uintParam("ln", 8)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	blockSize, err := phc.uintParam("r", 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	parallelism, err := phc.uintParam("p", 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	// N is int and must be greater than 1
+	if costLog2 == 0 || costLog2 >= 32 || len(phc.hash) == 0 {
+		return nil, nil, fmt.Errorf("%s: %w", op, errMalformedHash)
+	}
+
+	return NewScryptHasher(uint8(costLog2), int(blockSize), int(parallelism)), phc, nil
+}
@@ -0,0 +1,13 @@
+package mail
+
+import "context"
+
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
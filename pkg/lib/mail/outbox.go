@@ -0,0 +1,76 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Outbox keeps limit last sent messages in memory and, if path is specified, appends all of them to file as JSON lines.
+// It's used in tests and local environments without mail server
+type Outbox struct {
+	mu       sync.Mutex
+	path     string
+	limit    int
+	messages []Message
+}
+
+func NewOutbox(path string, limit int) *Outbox {
+	return &Outbox{
+		path:  path,
+		limit: limit,
+	}
+}
+
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	const op = "pkg.lib.mail.outbox.Send"
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.path != "" {
+		err := o.appendToFile(msg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if o.limit <= 0 {
+		return nil
+	}
+	if len(o.messages) == o.limit {
+		o.messages = append(o.messages[:0], o.messages[1:]...)
+	}
+	o.messages = append(o.messages, msg)
+
+	return nil
+}
+
+// Messages returns copy of messages kept in memory, the oldest first
+func (o *Outbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	messages := make([]Message, len(o.messages))
+	copy(messages, o.messages)
+
+	return messages
+}
+
+func (o *Outbox) appendToFile(msg Message) error {
+	file, err := os.OpenFile(o.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
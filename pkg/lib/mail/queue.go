@@ -0,0 +1,67 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var ErrQueueFull = errors.New("mail queue is full")
+
+// Queue sends messages in background, so slow mail server doesn't delay requests.
+// Up to size messages wait for delivery, the rest are rejected with ErrQueueFull.
+// Every delivery is limited by timeout, failed deliveries are logged
+type Queue struct {
+	log     *slog.Logger
+	sender  Sender
+	timeout time.Duration
+
+	messages chan Message
+}
+
+func NewQueue(log *slog.Logger, sender Sender, size int, timeout time.Duration) *Queue {
+	q := &Queue{
+		log:      log,
+		sender:   sender,
+		timeout:  timeout,
+		messages: make(chan Message, size),
+	}
+
+	go q.run()
+
+	return q
+}
+
+// Send enqueues message. It doesn't wait for delivery, so ctx is only checked before enqueueing
+func (q *Queue) Send(ctx context.Context, msg Message) error {
+	const op = "pkg.lib.mail.queue.Send"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	select {
+	case q.messages <- msg:
+		return nil
+	default:
+		return fmt.Errorf("%s: %w", op, ErrQueueFull)
+	}
+}
+
+func (q *Queue) run() {
+	const op = "pkg.lib.mail.queue.run"
+
+	log := q.log.With(slog.String("op", op))
+
+	for msg := range q.messages {
+		ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+		err := q.sender.Send(ctx, msg)
+		cancel()
+
+		if err != nil {
+			log.Error("can't send email", slog.String("err", err.Error()))
+		}
+	}
+}
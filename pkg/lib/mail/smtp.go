@@ -0,0 +1,140 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidHeader = errors.New("invalid mail header")
+
+type SMTPSender struct {
+	host string
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPSender creates sender which delivers messages through SMTP server.
+// If username is empty, messages are sent without authentication
+func NewSMTPSender(host string, port int, username, password, from string) *SMTPSender {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPSender{
+		host: host,
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		from: from,
+		auth: auth,
+	}
+}
+
+// Send delivers message like smtp.SendMail, but the whole conversation with server is limited by ctx deadline.
+// ErrInvalidHeader is returned if recipient isn't a single address or subject contains line breaks
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+	const op = "pkg.lib.mail.smtp.Send"
+
+	data, err := s.compose(msg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer conn.Close()
+
+	// smtp client doesn't take context, so connection is closed when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	err = s.send(conn, msg.To, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *SMTPSender) send(conn net.Conn, to string, data []byte) error {
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: s.host})
+		if err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		err = client.Auth(s.auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(s.from)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(to)
+	if err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// compose builds message. Recipient must be a bare address and subject is encoded, so neither can inject headers
+func (s *SMTPSender) compose(msg Message) ([]byte, error) {
+	address, err := netmail.ParseAddress(msg.To)
+	if err != nil || address.Address != msg.To {
+		return nil, ErrInvalidHeader
+	}
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, ErrInvalidHeader
+	}
+
+	var b strings.Builder
+
+	b.WriteString("From: " + s.from + "\r\n")
+	b.WriteString("To: " + address.Address + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+
+	return []byte(b.String()), nil
+}